@@ -128,6 +128,15 @@ func (p *Protocol) Sessions() SessionManagerInterface {
 	return p.sessions
 }
 
+//newProtocolRoute returns the root route of a protocol using the routeconfig
+func newProtocolRoute(service string, rc *RouteConfig) *Route {
+	r := NewRoute(service, rc.buffer, rc.timeout, rc.fail)
+	RetryRoute(r, rc.retry)
+	LimitRoute(r, rc.limit)
+	PriorityRoute(r, rc.priority)
+	return r
+}
+
 //BaseProtocol returns a new protocol instance
 func BaseProtocol(desc *ProtocolDescriptor, rc *RouteConfig) *Protocol {
 	return &Protocol{
@@ -135,7 +144,7 @@ func BaseProtocol(desc *ProtocolDescriptor, rc *RouteConfig) *Protocol {
 		make(chan struct{}),
 		NewSessionManager(),
 		rc,
-		NewRoute(desc.Service, rc.buffer, rc.timeout, rc.fail),
+		newProtocolRoute(desc.Service, rc),
 		flux.PushSocket(0),
 		flux.PushSocket(0),
 		flux.PushSocket(0),
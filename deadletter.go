@@ -0,0 +1,205 @@
+package servicedrop
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/influx6/flux"
+)
+
+const (
+	//DeadInvalid is the reason for requests not matching the root route
+	DeadInvalid = "invalid"
+	//DeadUnrouted is the reason for requests matching a route but none of its children
+	DeadUnrouted = "unrouted"
+	//DeadExpired is the reason for requests whose PayloadRack timed out
+	DeadExpired = "expired"
+	//DeadRejected is the reason for requests rejected by a full route queue
+	DeadRejected = "rejected"
+)
+
+//DeadLetter represents a request that was rejected or timed out within a route tree
+type DeadLetter struct {
+	Path    string      `json:"path"`
+	Reason  string      `json:"reason"`
+	Time    time.Time   `json:"time"`
+	Timeout int         `json:"timeout"`
+	Payload interface{} `json:"payload"`
+	Request *Request    `json:"-"`
+}
+
+//DeadLetters captures the dead letters of route trees into a bounded queue
+//where the oldest letters are dropped once the queue is full
+type DeadLetters struct {
+	letters []*DeadLetter
+	size    int
+	dropped int
+	lock    *sync.RWMutex
+}
+
+//NewDeadLetters returns a dead letter queue holding at most size letters
+func NewDeadLetters(size int) *DeadLetters {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &DeadLetters{
+		make([]*DeadLetter, 0, size),
+		size,
+		0,
+		new(sync.RWMutex),
+	}
+}
+
+//Watch captures the invalid, unrouted, rejected and expired requests of every
+//route within the route tree, routes added after the call are not watched
+func (d *DeadLetters) Watch(r *Route) {
+	r.Walk(func(rs *Route) {
+		rs.NotSub(func(req *Request, _ *flux.Sub) {
+			switch {
+			case req.Err == ErrRouteOverload:
+				d.Add(DeadRejected, req)
+			case rs.parent == nil:
+				d.Add(DeadInvalid, req)
+			}
+		})
+
+		rs.Valid.Subscribe(func(v interface{}, _ *flux.Sub) {
+			req, ok := v.(*Request)
+
+			if !ok || len(req.Paths) <= 1 {
+				return
+			}
+
+			if rs.Match(req.Paths) == rs {
+				d.Add(DeadUnrouted, req)
+			}
+		})
+
+		rs.ExpiredSub(func(req *Request, _ *flux.Sub) {
+			d.Add(DeadExpired, req)
+		})
+	})
+}
+
+//Add captures a request with the giving reason into the queue
+func (d *DeadLetters) Add(reason string, req *Request) {
+	payload := req.Payload
+
+	if rack, ok := payload.(*PayloadRack); ok {
+		payload = rack.Value()
+	}
+
+	letter := &DeadLetter{
+		Path:    req.Path,
+		Reason:  reason,
+		Time:    time.Now(),
+		Timeout: req.Timeout,
+		Payload: payload,
+		Request: req,
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.letters) >= d.size {
+		d.letters = d.letters[1:]
+		d.dropped++
+	}
+
+	d.letters = append(d.letters, letter)
+}
+
+//Letters returns the current letters within the queue
+func (d *DeadLetters) Letters() []*DeadLetter {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return append([]*DeadLetter(nil), d.letters...)
+}
+
+//Len returns the total letters within the queue
+func (d *DeadLetters) Len() int {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return len(d.letters)
+}
+
+//Dropped returns the total letters dropped due to the queue being full
+func (d *DeadLetters) Dropped() int {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.dropped
+}
+
+//Drain empties the queue and returns its letters
+func (d *DeadLetters) Drain() []*DeadLetter {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	letters := d.letters
+	d.letters = make([]*DeadLetter, 0, d.size)
+	return letters
+}
+
+//Replay drains the queue and serves each letter with its original path,
+//payload and timeout into the route, returning the total replayed
+func (d *DeadLetters) Replay(r *Route) int {
+	letters := d.Drain()
+
+	for _, l := range letters {
+		r.ServeRequest(NewRequest(l.Path, l.Payload, nil, l.Timeout))
+	}
+
+	return len(letters)
+}
+
+//WriteTo writes the letters within the queue as json lines, payloads which
+//can not be encoded as json are written in their string form
+func (d *DeadLetters) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+
+	var total int64
+
+	for _, l := range d.Letters() {
+		data, err := json.Marshal(l)
+
+		if err != nil {
+			cl := *l
+			cl.Payload = fmt.Sprintf("%+v", l.Payload)
+
+			if data, err = json.Marshal(&cl); err != nil {
+				return total, err
+			}
+		}
+
+		n, err := bw.Write(append(data, '\n'))
+		total += int64(n)
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, bw.Flush()
+}
+
+//Save writes the letters within the queue into the giving file
+func (d *DeadLetters) Save(file string) error {
+	fs, err := os.Create(file)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.WriteTo(fs); err != nil {
+		fs.Close()
+		return err
+	}
+
+	return fs.Close()
+}
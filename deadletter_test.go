@@ -0,0 +1,81 @@
+package servicedrop
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitLetters(d *DeadLetters, n int) bool {
+	deadline := time.Now().Add(time.Second)
+
+	for time.Now().Before(deadline) {
+		if d.Len() >= n {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestDeadLetters(t *testing.T) {
+	r := NewRoute("apple", 2, 0, nil)
+	r.New("red")
+
+	dead := NewDeadLetters(10)
+	dead.Watch(r)
+
+	r.Serve("pear", "green!", 0)
+	r.Serve("apple/blue", "blue!", 0)
+
+	if !waitLetters(dead, 2) {
+		t.Fatalf("dead letters were not captured: %d", dead.Len())
+	}
+
+	reasons := make(map[string]string)
+	for _, l := range dead.Letters() {
+		reasons[l.Path] = l.Reason
+	}
+
+	if reasons["pear"] != DeadInvalid {
+		t.Fatalf("invalid request captured with reason %q", reasons["pear"])
+	}
+
+	if reasons["apple/blue"] != DeadUnrouted {
+		t.Fatalf("unrouted request captured with reason %q", reasons["apple/blue"])
+	}
+
+	var buf bytes.Buffer
+
+	if _, err := dead.WriteTo(&buf); err != nil {
+		t.Fatal("unable to write dead letters", err)
+	}
+
+	if strings.Count(buf.String(), "\n") != 2 {
+		t.Fatalf("dead letters written incorrectly: %s", buf.String())
+	}
+
+	if n := dead.Replay(r); n != 2 {
+		t.Fatalf("replayed %d dead letters", n)
+	}
+
+	if !waitLetters(dead, 2) {
+		t.Fatalf("replayed dead letters were not captured again: %d", dead.Len())
+	}
+}
+
+func TestDeadLettersBound(t *testing.T) {
+	dead := NewDeadLetters(2)
+
+	for _, path := range []string{"a", "b", "c"} {
+		dead.Add(DeadInvalid, NewRequest(path, nil, nil, 0))
+	}
+
+	letters := dead.Letters()
+
+	if len(letters) != 2 || letters[0].Path != "b" || dead.Dropped() != 1 {
+		t.Fatalf("dead letter queue is not bounded: %+v", letters)
+	}
+}
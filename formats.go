@@ -10,7 +10,6 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
-	"time"
 
 	// "code.google.com/p/go.crypto/ssh"
 
@@ -74,34 +73,6 @@ type (
 		Write io.Writer
 		Erros io.Writer
 	}
-
-	//SessionManagerInterface represent the member function rules for a session manager
-	SessionManagerInterface interface {
-		AddSession(net.Addr, Session)
-		DestroySession(net.Addr)
-		GetSession(net.Addr) (Session, error)
-	}
-
-	//SessionManager is used to managed session data for any service using the
-	//net.Addr as a key
-	SessionManager struct {
-		sessions *flux.SecureMap
-	}
-
-	//Session is a map that can contain the data needed for use
-	Session interface {
-		UseType(string)
-		Type() string
-		UUID() string
-		Addr() string
-		User() string
-		Pass() []byte
-		Start() time.Time
-		End() time.Time
-		Incoming() flux.StreamInterface
-		Outgoing() flux.StreamInterface
-		Close()
-	}
 )
 
 var (
@@ -142,12 +113,18 @@ type KeyAuthenticationCallback func(ProtocolInterface, ssh.ConnMetadata, ssh.Pub
 //PasswordAuthenticationCallback is the type for the ssh-server password-callback function
 type PasswordAuthenticationCallback func(ProtocolInterface, ssh.ConnMetadata, []byte) (*ssh.Permissions, error)
 
+//InteractiveAuthenticationCallback is the type for the ssh-server keyboard-interactive-callback function
+type InteractiveAuthenticationCallback func(ProtocolInterface, ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+
 //KeyAuth represents a PublicCallback type
 type KeyAuth func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)
 
 //PassAuth represents a PasswordCallback type
 type PassAuth func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error)
 
+//InteractiveAuth represents a KeyboardInteractiveCallback type
+type InteractiveAuth func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+
 //PasswordAuthenticationWrap wraps a PasswordAuthenticationCallback for use
 func PasswordAuthenticationWrap(auth PasswordAuthenticationCallback, p ProtocolInterface) PassAuth {
 	return func(meta ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
@@ -162,35 +139,11 @@ func KeyAuthenticationWrap(auth KeyAuthenticationCallback, p ProtocolInterface)
 	}
 }
 
-//NewSessionManager allows management of sessions(ambiguous up to you to define that)
-func NewSessionManager() *SessionManager {
-	return &SessionManager{flux.NewSecureMap()}
-}
-
-//GetSession retrieves a session with the net.Addr
-func (s *SessionManager) GetSession(addr net.Addr) (Session, error) {
-	sm, ok := s.sessions.Get(addr).(Session)
-
-	if ok {
-		return sm, nil
-	}
-
-	return sm, ErrorNotFind
-}
-
-//AddSession adds a new settion with the address
-func (s *SessionManager) AddSession(addr net.Addr, sm Session) {
-	s.sessions.Set(addr, sm)
-}
-
-//DestroySession deletes a session and its content from the map
-func (s *SessionManager) DestroySession(addr net.Addr) {
-	sh, err := s.GetSession(addr)
-	if err != nil {
-		return
+//InteractiveAuthenticationWrap wraps a InteractiveAuthenticationCallback for use
+func InteractiveAuthenticationWrap(auth InteractiveAuthenticationCallback, p ProtocolInterface) InteractiveAuth {
+	return func(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		return auth(p, meta, client)
 	}
-	defer sh.Close()
-	s.sessions.Remove(addr)
 }
 
 //NewSSHClientSession creates a new ssh session instance
@@ -231,9 +231,41 @@ func TCPStream(src net.Conn, dest net.Conn, in, out flux.StackStreamers) ProxySt
 	return ts
 }
 
+//handleOperation closes the other side once either side of the stream ends
+//and both once the stream is closed, the ProxyStream's own handleOperation
+//would only call its no-op CloseDest and CloseSrc
+func (p *TCPProxyStream) handleOperation() {
+	go reportError(p.ErrNotify())
+
+	var ex error
+
+	select {
+	case <-p.CloseNotify():
+		if ex = p.CloseDest(); ex == nil {
+			ex = p.CloseSrc()
+		}
+	case <-p.SrcNotify():
+		ex = p.CloseDest()
+	case <-p.DestNotify():
+		ex = p.CloseSrc()
+	}
+
+	if ex != nil {
+		go func() { p.ErrNotify() <- ex }()
+	}
+}
+
+//notify signals the notifier without blocking if it was already signalled
+func notify(n Notifier) {
+	select {
+	case n <- struct{}{}:
+	default:
+	}
+}
+
 //CloseDest closes the destination
 func (p *TCPProxyStream) CloseDest() error {
-	p.DestNotify() <- struct{}{}
+	notify(p.DestNotify())
 	return p.dest.Close()
 }
 
@@ -255,7 +287,7 @@ func (p *TCPProxyStream) handleProcess() {
 
 //CloseSrc closes the destination
 func (p *TCPProxyStream) CloseSrc() error {
-	p.SrcNotify() <- struct{}{}
+	notify(p.SrcNotify())
 	return p.src.Close()
 }
 
@@ -287,7 +319,7 @@ func (p *TCPProxyStream) DoBroker(dest io.WriteCloser, src io.ReadCloser, end No
 		go func() { p.errorend <- ex }()
 	}
 
-	end <- struct{}{}
+	notify(end)
 }
 
 //handleProcess process handles the operation of the streams
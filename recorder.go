@@ -0,0 +1,216 @@
+package servicedrop
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/influx6/flux"
+)
+
+//PayloadEncoder provides the encoding of request payloads for recordings
+type PayloadEncoder interface {
+	Name() string
+	Encode(interface{}) ([]byte, error)
+	Decode([]byte) (interface{}, error)
+}
+
+//JSONPayloadEncoder encodes payloads as json, decoded payloads are the
+//generic json values (eg. map[string]interface{}, float64)
+type JSONPayloadEncoder struct{}
+
+//Name returns the name of the encoder
+func (JSONPayloadEncoder) Name() string {
+	return "json"
+}
+
+//Encode encodes the payload as json
+func (JSONPayloadEncoder) Encode(b interface{}) ([]byte, error) {
+	return json.Marshal(b)
+}
+
+//Decode decodes the payload from json
+func (JSONPayloadEncoder) Decode(data []byte) (interface{}, error) {
+	var b interface{}
+	err := json.Unmarshal(data, &b)
+	return b, err
+}
+
+//BytesPayloadEncoder encodes string and []byte payloads as is, decoded
+//payloads are []byte
+type BytesPayloadEncoder struct{}
+
+//Name returns the name of the encoder
+func (BytesPayloadEncoder) Name() string {
+	return "bytes"
+}
+
+//Encode returns the payload bytes
+func (BytesPayloadEncoder) Encode(b interface{}) ([]byte, error) {
+	switch bo := b.(type) {
+	case []byte:
+		return bo, nil
+	case string:
+		return []byte(bo), nil
+	case nil:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("bytes encoder: unsupported payload type %T", b)
+}
+
+//Decode returns the payload bytes
+func (BytesPayloadEncoder) Decode(data []byte) (interface{}, error) {
+	return data, nil
+}
+
+//RecordedRequest represents a request recorded from a route, At is the time
+//the request was served since the recording started
+type RecordedRequest struct {
+	At       time.Duration `json:"at"`
+	Path     string        `json:"path"`
+	Timeout  int           `json:"timeout"`
+	Encoding string        `json:"encoding"`
+	Payload  []byte        `json:"payload"`
+}
+
+//RouteRecorder records every request entering a route as json lines
+type RouteRecorder struct {
+	enc   PayloadEncoder
+	out   *bufio.Writer
+	start time.Time
+	subs  []*flux.Sub
+	lock  *sync.Mutex
+}
+
+//NewRouteRecorder returns a recorder writing into the writer using the
+//encoder for the request payloads
+func NewRouteRecorder(w io.Writer, enc PayloadEncoder) *RouteRecorder {
+	return &RouteRecorder{
+		enc,
+		bufio.NewWriter(w),
+		time.Now(),
+		nil,
+		new(sync.Mutex),
+	}
+}
+
+//Record starts recording the requests served into the route
+func (rc *RouteRecorder) Record(r *Route) {
+	sub := r.AllSub(func(req *Request, _ *flux.Sub) {
+		rc.record(req)
+	})
+
+	rc.lock.Lock()
+	rc.subs = append(rc.subs, sub)
+	rc.lock.Unlock()
+}
+
+//record encodes and writes the request into the recording
+func (rc *RouteRecorder) record(req *Request) {
+	payload := req.Payload
+
+	if rack, ok := payload.(*PayloadRack); ok {
+		payload = rack.Value()
+	}
+
+	data, err := rc.enc.Encode(payload)
+
+	if err != nil {
+		log.Printf("Unable to record request for (%s): %+v", req.Path, err)
+		return
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	line, err := json.Marshal(&RecordedRequest{
+		time.Since(rc.start),
+		req.Path,
+		req.Timeout,
+		rc.enc.Name(),
+		data,
+	})
+
+	if err != nil {
+		log.Printf("Unable to record request for (%s): %+v", req.Path, err)
+		return
+	}
+
+	rc.out.Write(append(line, '\n'))
+}
+
+//Flush writes any buffered recorded requests
+func (rc *RouteRecorder) Flush() error {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.out.Flush()
+}
+
+//Stop ends the recording of all routes and flushes the recording
+func (rc *RouteRecorder) Stop() error {
+	rc.lock.Lock()
+	subs := rc.subs
+	rc.subs = nil
+	rc.lock.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+
+	return rc.Flush()
+}
+
+//ReplayRecording serves the recorded requests from the reader into the route,
+//the speed of 1 keeps the original timing, 2 replays twice as fast and 0 replays
+//without waiting, the payloads are decoded by the encoder matching their name
+func ReplayRecording(rd io.Reader, r *Route, speed float64, encoders ...PayloadEncoder) (int, error) {
+	encs := make(map[string]PayloadEncoder)
+
+	for _, enc := range encoders {
+		encs[enc.Name()] = enc
+	}
+
+	dec := json.NewDecoder(rd)
+	start := time.Now()
+
+	var total int
+
+	for {
+		var rq RecordedRequest
+
+		if err := dec.Decode(&rq); err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+
+		enc, ok := encs[rq.Encoding]
+
+		if !ok {
+			return total, fmt.Errorf("replay: no payload encoder for %q", rq.Encoding)
+		}
+
+		payload, err := enc.Decode(rq.Payload)
+
+		if err != nil {
+			return total, err
+		}
+
+		if speed > 0 {
+			at := time.Duration(float64(rq.At) / speed)
+
+			if wait := at - time.Since(start); wait > 0 {
+				<-time.After(wait)
+			}
+		}
+
+		r.ServeRequest(NewRequest(rq.Path, payload, nil, rq.Timeout))
+		total++
+	}
+}
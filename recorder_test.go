@@ -0,0 +1,60 @@
+package servicedrop
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/influx6/flux"
+)
+
+func TestRouteRecorder(t *testing.T) {
+	var buf bytes.Buffer
+
+	r := NewRoute("apple", 2, 0, nil)
+	rc := NewRouteRecorder(&buf, JSONPayloadEncoder{})
+	rc.Record(r)
+
+	r.Serve("apple", map[string]interface{}{"color": "red"}, 0)
+	r.Serve("apple/20", "green", 0)
+
+	if err := rc.Stop(); err != nil {
+		t.Fatal("unable to flush recording", err)
+	}
+
+	wait := new(sync.WaitGroup)
+	var payloads []interface{}
+	var lock sync.Mutex
+
+	fresh := NewRoute("apple", 2, 0, nil)
+	fresh.Sub(func(r *Request, s *flux.Sub) {
+		lock.Lock()
+		payloads = append(payloads, r.Payload)
+		lock.Unlock()
+		wait.Done()
+	})
+
+	wait.Add(2)
+	total, err := ReplayRecording(&buf, fresh, 0, JSONPayloadEncoder{})
+
+	if err != nil {
+		t.Fatal("unable to replay recording", err)
+	}
+
+	if total != 2 {
+		t.Fatalf("replayed %d requests instead of 2", total)
+	}
+
+	wait.Wait()
+
+	var found bool
+	for _, py := range payloads {
+		if py == "green" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("replayed requests have incorrect payloads: %+v", payloads)
+	}
+}
@@ -1,9 +1,12 @@
 package servicedrop
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/influx6/flux"
@@ -12,14 +15,81 @@ import (
 
 //RouteConfig handles the initialization of protocols route
 type RouteConfig struct {
-	buffer  int
-	timeout int
-	fail    Failure
+	buffer   int
+	timeout  int
+	fail     Failure
+	retry    *RetryPolicy
+	limit    *RouteLimit
+	priority *RoutePriority
 }
 
 //NewRouteConfig returns a routeconfig with its details
 func NewRouteConfig(buf, to int, fail Failure) *RouteConfig {
-	return &RouteConfig{buf, to, fail}
+	return &RouteConfig{buf, to, fail, nil, nil, nil}
+}
+
+//WithPriority sets the route subscribers to receive higher priority requests first
+func (rc *RouteConfig) WithPriority(priority *RoutePriority) *RouteConfig {
+	rc.priority = priority
+	return rc
+}
+
+//WithLimit sets the concurrency limit and overload policy of the route subscribers
+func (rc *RouteConfig) WithLimit(limit *RouteLimit) *RouteConfig {
+	rc.limit = limit
+	return rc
+}
+
+//WithRetry sets the retry policy used by the PayloadRacks of the route
+func (rc *RouteConfig) WithRetry(retry *RetryPolicy) *RouteConfig {
+	rc.retry = retry
+	return rc
+}
+
+//RetryPolicy defines how a PayloadRack re-offers its payload to the route when
+//it was not collected before the timeout, MaxAttempts is the total offers made
+//before the Failure action is fired and the delay between offers grows
+//exponentially from Backoff up to MaxBackoff with a Jitter fraction (0-1)
+//removed at random, Retryable when set decides which payloads can be re-offered
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Jitter      float64
+	Retryable   func(interface{}) bool
+}
+
+//Delay returns the backoff to wait after the giving attempt
+func (r *RetryPolicy) Delay(attempt int) time.Duration {
+	d := r.Backoff
+
+	for i := 1; i < attempt; i++ {
+		d *= 2
+
+		if r.MaxBackoff > 0 && d >= r.MaxBackoff {
+			d = r.MaxBackoff
+			break
+		}
+	}
+
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+
+	if r.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * r.Jitter * float64(d))
+	}
+
+	return d
+}
+
+//allows returns true if the payload can be re-offered after the giving attempt
+func (r *RetryPolicy) allows(attempt int, payload interface{}) bool {
+	if attempt >= r.MaxAttempts {
+		return false
+	}
+
+	return r.Retryable == nil || r.Retryable(payload)
 }
 
 //BasicRouteConfig returns a default no-op failure routeconfig
@@ -37,36 +107,81 @@ type Failure func(flux.ActionInterface)
 //instantly resolves the timeout set for the rack
 //the timeout value will be multiplied by time.Millisecond so choose appropriately
 //Note: If the timeout is a negative number then its seen as an immediate resolve
-//else the normal process of time after is done
+//else the normal process of time after is done, with a retry policy the payload
+//is re-offered after each timeout until its attempts are used up
 type PayloadRack struct {
-	payload chan interface{}
-	timeout time.Duration
-	fail    flux.ActionInterface
-	done    flux.ActionInterface
-	once    *sync.Once
+	payload  chan interface{}
+	timeout  time.Duration
+	fail     flux.ActionInterface
+	done     flux.ActionInterface
+	once     *sync.Once
+	expired  func()
+	data     interface{}
+	retry    *RetryPolicy
+	reoffer  func()
+	attempts int
+	closer   *sync.Once
 }
 
 //Load sets the payloadrack payload
 func (p *PayloadRack) Load(b interface{}) {
 	p.once.Do(func() {
-		go func() {
-			if p.timeout <= -1 {
-				go p.collect()
-			} else {
-				go func() {
-					<-time.After(p.timeout)
-					payload, ok := <-p.payload
-					if ok {
-						p.fail.Fullfill(payload)
-					}
-				}()
-			}
-			p.payload <- b
-			close(p.payload)
-		}()
+		p.data = b
+		if p.timeout <= -1 {
+			go p.collect()
+		} else {
+			go p.expire()
+		}
+		go p.offer(b)
 	})
 }
 
+//offer hands the payload to either a collector or the expiry
+func (p *PayloadRack) offer(b interface{}) {
+	p.payload <- b
+}
+
+//finish closes the payload channel once the payload is collected or failed
+func (p *PayloadRack) finish() {
+	p.closer.Do(func() {
+		close(p.payload)
+	})
+}
+
+//expire waits for the timeout and either re-offers the payload if the retry
+//policy allows or fullfills the fail action
+func (p *PayloadRack) expire() {
+	for {
+		<-time.After(p.timeout)
+
+		payload, ok := <-p.payload
+
+		if !ok {
+			return
+		}
+
+		p.attempts++
+
+		if p.expired != nil {
+			p.expired()
+		}
+
+		if p.retry == nil || !p.retry.allows(p.attempts, payload) {
+			p.finish()
+			p.fail.Fullfill(payload)
+			return
+		}
+
+		<-time.After(p.retry.Delay(p.attempts))
+
+		go p.offer(payload)
+
+		if p.reoffer != nil {
+			p.reoffer()
+		}
+	}
+}
+
 //collect retrieves the data from the channel and fullfills the done action
 func (p *PayloadRack) collect() {
 	pkt, ok := <-p.payload
@@ -75,9 +190,15 @@ func (p *PayloadRack) collect() {
 		return
 	}
 
+	p.finish()
 	p.done.Fullfill(pkt)
 }
 
+//Value returns the payload loaded into the rack without collecting it
+func (p *PayloadRack) Value() interface{} {
+	return p.data
+}
+
 //Failed returns a packet's fail ActionInterface
 func (p *PayloadRack) Failed() flux.ActionInterface {
 	return p.fail.Wrap()
@@ -97,6 +218,12 @@ func NewPayloadRack(timeout int, fx Failure) *PayloadRack {
 		flux.NewAction(),
 		flux.NewAction(),
 		new(sync.Once),
+		nil,
+		nil,
+		nil,
+		nil,
+		0,
+		new(sync.Once),
 	}
 
 	if fx != nil {
@@ -106,6 +233,40 @@ func NewPayloadRack(timeout int, fx Failure) *PayloadRack {
 	return p
 }
 
+//routeNames stores the routes registered by name within a route tree
+type routeNames struct {
+	routes map[string]*Route
+	lock   *sync.RWMutex
+}
+
+func newRouteNames() *routeNames {
+	return &routeNames{
+		make(map[string]*Route),
+		new(sync.RWMutex),
+	}
+}
+
+func (n *routeNames) add(name string, r *Route) {
+	n.lock.Lock()
+	n.routes[name] = r
+	n.lock.Unlock()
+}
+
+func (n *routeNames) get(name string) *Route {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.routes[name]
+}
+
+var (
+	//ErrRouteNotFound is returned when no route is registered with a name
+	ErrRouteNotFound = errors.New("route name not found")
+	//ErrRouteParamMissing is returned when a param for a route pattern is not provided
+	ErrRouteParamMissing = errors.New("missing route param")
+	//ErrRouteParamInvalid is returned when a param does not match its route pattern
+	ErrRouteParamInvalid = errors.New("route param does not match pattern")
+)
+
 //Sub aliases flux.Sub for use by route
 // type Sub flux.Sub
 
@@ -128,11 +289,21 @@ type RouteInterface interface {
 }
 
 //Request represent a request payload to be sent into a route
+//the Path contains the full path the request was served with and Err
+//the reason a route rejected the request if any, the Priority is only
+//used by routes with a RoutePriority where higher values are delivered first
+//and the ID correlates the request to its replies when served with Route.ServeReply
 type Request struct {
-	Paths   []string
-	Payload interface{}
-	Param   interface{}
-	Timeout int
+	Paths    []string
+	Payload  interface{}
+	Param    interface{}
+	Timeout  int
+	Path     string
+	Err      error
+	Priority int
+	ID       string
+	replies  replier
+	sub      string
 }
 
 //NewRequest returns a new request packet from a path and payload with an
@@ -143,6 +314,12 @@ func NewRequest(path string, pay interface{}, param interface{}, ts int) *Reques
 		pay,
 		param,
 		ts,
+		trimSlash(path),
+		nil,
+		0,
+		"",
+		nil,
+		"",
 	}
 }
 
@@ -158,6 +335,12 @@ func FromRequest(r *Request, param interface{}) *Request {
 		r.Payload,
 		param,
 		r.Timeout,
+		r.Path,
+		nil,
+		r.Priority,
+		r.ID,
+		r.replies,
+		"",
 	}
 }
 
@@ -166,28 +349,39 @@ type Route struct {
 	flux.SocketInterface
 	childRoutes map[string]*Route
 	Path        string
+	Name        string
 	Pattern     *reggy.ClassicMatcher
 	Valid       *flux.Push
 	Invalid     *flux.Push
+	Expired     *flux.Push
 	DTO         int
+	Metrics     *RouteMetrics
 	lock        *sync.RWMutex
 	fail        Failure
+	retry       *RetryPolicy
+	limit       *RouteLimit
+	priority    *RoutePriority
+	parent      *Route
+	names       *routeNames
+	queue       *routeQueue
+	subs        []*routeSub
+	subn        int
 }
 
 //New adds a new route to the current routes routemaker as a subroute
 //the path string can only be a single route not a multiple
 //So '/io/sucker/{f:[/w]}' will be broken down and each piece will be created
-//according to its tree
+//according to its tree and the final route of the path is returned
 //Note: '/' returns the route itself
-func (r *Route) New(path string) {
+func (r *Route) New(path string) *Route {
 	if strings.EqualFold(path, "/") || path == "" {
-		return
+		return r
 	}
 
 	vs := splitPatternAndRemovePrefix(path)
 
 	if len(vs) <= 0 {
-		return
+		return r
 	}
 
 	fs := vs[0]
@@ -211,11 +405,79 @@ func (r *Route) New(path string) {
 		r.childRoutes[rs.Path] = rs
 		r.lock.Unlock()
 
-		rs.New(strings.Join(vs, "/"))
-		return
+		return rs.New(strings.Join(vs, "/"))
+	}
+
+	return d.New(strings.Join(vs, "/"))
+}
+
+//NewNamed adds a new route just like Route.New but registers the final route
+//of the path under the giving name, which can then be used with Route.URL
+func (r *Route) NewNamed(name, path string) *Route {
+	rs := r.New(path)
+	rs.Name = name
+	r.names.add(name, rs)
+	return rs
+}
+
+//Named returns the route registered with the giving name within this route
+//tree or nil if none exists
+func (r *Route) Named(name string) *Route {
+	return r.names.get(name)
+}
+
+//Parent returns the route this route was created from or nil if its a root
+func (r *Route) Parent() *Route {
+	return r.parent
+}
+
+//FullPath returns the patterns of this route and its parents joined
+//from the root eg. 'io/session/{id:[\d+]}'
+func (r *Route) FullPath() string {
+	var paths []string
+
+	for rs := r; rs != nil; rs = rs.parent {
+		paths = append([]string{rs.Path}, paths...)
+	}
+
+	return strings.Join(paths, "/")
+}
+
+//URL builds a concrete path for the route registered with the giving name,
+//the params map provides the values for each pattern segment eg. for
+//'io/{id:[\d+]}' a map of {"id":"20"} returns '/io/20', each value is
+//validated against its segment pattern and an error is returned on a mismatch
+func (r *Route) URL(name string, params map[string]string) (string, error) {
+	rs := r.names.get(name)
+
+	if rs == nil {
+		return "", fmt.Errorf("route %q: %v", name, ErrRouteNotFound)
+	}
+
+	var paths []string
+
+	for ; rs != nil; rs = rs.parent {
+		id, _, special := reggy.YankSpecial(rs.Path)
+
+		if !special {
+			paths = append([]string{rs.Path}, paths...)
+			continue
+		}
+
+		val, ok := params[id]
+
+		if !ok {
+			return "", fmt.Errorf("route %q: %v %q", name, ErrRouteParamMissing, id)
+		}
+
+		if !rs.Pattern.Validate(val) {
+			return "", fmt.Errorf("route %q: %v %q with %q", name, ErrRouteParamInvalid, id, val)
+		}
+
+		paths = append([]string{val}, paths...)
 	}
 
-	d.New(strings.Join(vs, "/"))
+	return "/" + strings.Join(paths, "/"), nil
 }
 
 //Children returns the total child routes possed by these route
@@ -257,9 +519,157 @@ func (r *Route) Child(path string) *Route {
 	return d.Child(strings.Join(vs, "/"))
 }
 
+//Match returns the deepest route within this route tree whose patterns match
+//the giving paths or nil if this route does not match the first path
+func (r *Route) Match(paths []string) *Route {
+	if len(paths) <= 0 || !r.Pattern.Validate(paths[0]) {
+		return nil
+	}
+
+	if len(paths) == 1 {
+		return r
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, rs := range r.childRoutes {
+		if d := rs.Match(paths[1:]); d != nil {
+			return d
+		}
+	}
+
+	return r
+}
+
 //Sub decorates the Route.Valid.Subscribe with a more request friendly closure caller
+//and records the time taken by the closure in the route metrics, if the route has
+//a limit or priority the requests are queued and handled by the limit's concurrency
+//Each closure is registered as a subscriber of the route which its replies to
+//requests served with Route.ServeReply or Route.Scatter are made as until it is
+//removed with Route.Unsub
 func (r *Route) Sub(fnx func(r *Request, s *flux.Sub)) *flux.Sub {
-	return r.Valid.Subscribe(func(v interface{}, fs *flux.Sub) {
+	rs := &routeSub{metrics: r.Metrics, queue: r.queue}
+
+	r.lock.Lock()
+	r.subn++
+	rs.id = fmt.Sprintf("%s#%d", r.FullPath(), r.subn)
+	r.subs = append(r.subs, rs)
+	r.lock.Unlock()
+
+	rs.handle = func(req *Request, fs *flux.Sub) {
+		if req.replies != nil {
+			rq := *req
+			rq.sub = rs.id
+			req = &rq
+		}
+
+		start := time.Now()
+		fnx(req, fs)
+		r.Metrics.observe(time.Since(start))
+	}
+
+	var sub *flux.Sub
+
+	if rs.queue == nil {
+		sub = r.Valid.Subscribe(func(v interface{}, fs *flux.Sub) {
+			req, ok := v.(*Request)
+
+			if !ok {
+				return
+			}
+
+			rs.handle(req, fs)
+		})
+	} else {
+		rs.queue.add()
+
+		sub = r.Valid.Subscribe(func(v interface{}, fs *flux.Sub) {
+			req, ok := v.(*Request)
+
+			if !ok {
+				return
+			}
+
+			if rs.queue.push(req, rs, fs) || rs.queue.policy != OverloadReject {
+				return
+			}
+
+			rq := *req
+			rq.Err = ErrRouteOverload
+			r.Invalid.Emit(&rq)
+		})
+	}
+
+	r.lock.Lock()
+	rs.sub = sub
+	r.lock.Unlock()
+
+	return sub
+}
+
+//Unsub closes a subscriber added with Route.Sub and removes it from the route,
+//the requests still queued for the subscriber are dropped
+func (r *Route) Unsub(sub *flux.Sub) {
+	sub.Close()
+
+	var rs *routeSub
+
+	r.lock.Lock()
+	for i, s := range r.subs {
+		if s.sub == sub {
+			rs = s
+			r.subs = append(r.subs[:i:i], r.subs[i+1:]...)
+			break
+		}
+	}
+	r.lock.Unlock()
+
+	if rs == nil {
+		return
+	}
+
+	atomic.StoreInt32(&rs.closed, 1)
+
+	if rs.queue != nil {
+		rs.queue.remove(rs)
+	}
+}
+
+//Subscribers returns the ids of the subscribers added to the route with Route.Sub
+func (r *Route) Subscribers() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	ids := make([]string, 0, len(r.subs))
+
+	for _, rs := range r.subs {
+		ids = append(ids, rs.id)
+	}
+
+	return ids
+}
+
+//Walk calls the function with this route and every route within its tree
+func (r *Route) Walk(fx func(*Route)) {
+	fx(r)
+
+	r.lock.RLock()
+	childs := make([]*Route, 0, len(r.childRoutes))
+	for _, rs := range r.childRoutes {
+		childs = append(childs, rs)
+	}
+	r.lock.RUnlock()
+
+	for _, rs := range childs {
+		rs.Walk(fx)
+	}
+}
+
+//AllSub decorates the Route.Subscribe with a more request friend closure caller,
+//its closure is not bounded by the route limit
+func (r *Route) AllSub(fnx func(r *Request, s *flux.Sub)) *flux.Sub {
+	return r.Subscribe(func(v interface{}, fs *flux.Sub) {
 		req, ok := v.(*Request)
 
 		if !ok {
@@ -270,9 +680,9 @@ func (r *Route) Sub(fnx func(r *Request, s *flux.Sub)) *flux.Sub {
 	})
 }
 
-//AllSub decorates the Route.Subscribe with a more request friend closure caller
-func (r *Route) AllSub(fnx func(r *Request, s *flux.Sub)) *flux.Sub {
-	return r.Subscribe(func(v interface{}, fs *flux.Sub) {
+//ExpiredSub decorates the Route.Expired.Subscribe with a more request friendly closure caller
+func (r *Route) ExpiredSub(fnx func(r *Request, s *flux.Sub)) *flux.Sub {
+	return r.Expired.Subscribe(func(v interface{}, fs *flux.Sub) {
 		req, ok := v.(*Request)
 
 		if !ok {
@@ -283,7 +693,8 @@ func (r *Route) AllSub(fnx func(r *Request, s *flux.Sub)) *flux.Sub {
 	})
 }
 
-//NotSub decorates the Route.Invalid.Subscribe with a more request friend closure caller
+//NotSub decorates the Route.Invalid.Subscribe with a more request friend closure caller,
+//its closure is not bounded by the route limit
 func (r *Route) NotSub(fnx func(r *Request, s *flux.Sub)) *flux.Sub {
 	return r.Invalid.Subscribe(func(v interface{}, fs *flux.Sub) {
 		req, ok := v.(*Request)
@@ -305,6 +716,8 @@ func (r *Route) NotSub(fnx func(r *Request, s *flux.Sub)) *flux.Sub {
 //rule and then pass it to the next route in its range else drops that packet into
 //its Invalid socket, also all child routes that extend from a base will all recieve
 //the parents Invalid socket so you can deal with routes that dont match in one place
+//Requests whose PayloadRack fails are emitted into the Expired socket of the deepest
+//route matching their path
 func RawRoute(path string, base *flux.Push, invalid *flux.Push, ts int, fail Failure) *Route {
 	if path == "" {
 		panic("route path can not be an empty string")
@@ -315,12 +728,23 @@ func RawRoute(path string, base *flux.Push, invalid *flux.Push, ts int, fail Fai
 		base,
 		make(map[string]*Route),
 		m.Original,
+		"",
 		m,
 		nil,
 		invalid,
+		flux.PushSocket(0),
 		ts,
+		NewRouteMetrics(),
 		new(sync.RWMutex),
 		fail,
+		nil,
+		nil,
+		nil,
+		nil,
+		newRouteNames(),
+		nil,
+		nil,
+		0,
 	}
 
 	//add new socket for valid routes and optional can made into payloadable
@@ -331,23 +755,50 @@ func RawRoute(path string, base *flux.Push, invalid *flux.Push, ts int, fail Fai
 			return
 		}
 
+		r.Metrics.served()
+
 		if r.fail != nil {
 			_, ok = req.Payload.(*PayloadRack)
 
 			if !ok {
+				//the deepest route matching the request provides its timeout and failure
+				rs := r.Match(req.Paths)
+
+				if rs == nil {
+					rs = r
+				}
 
 				var to int
 				if req.Timeout == 0 {
-					to = r.DTO
+					to = rs.DTO
 				} else {
 					to = req.Timeout
 				}
 
+				fx := rs.fail
+				if fx == nil {
+					fx = r.fail
+				}
+
+				retry := rs.retry
+				if retry == nil {
+					retry = r.retry
+				}
+
 				py := req.Payload
-				pl := NewPayloadRack(to, fail)
+				pl := NewPayloadRack(to, fx)
+				pl.retry = retry
+				pl.reoffer = func() {
+					r.Valid.Emit(req)
+				}
+				pl.expired = rs.Metrics.timedOut
+				pl.Failed().When(func(_ interface{}, _ flux.ActionInterface) {
+					rs.Metrics.failed()
+					rs.Expired.Emit(req)
+				})
 
-				req.Payload = pl
 				pl.Load(py)
+				req.Payload = pl
 			}
 		}
 
@@ -356,10 +807,12 @@ func RawRoute(path string, base *flux.Push, invalid *flux.Push, ts int, fail Fai
 		ok = r.Pattern.Validate(f)
 
 		if !ok {
+			r.Metrics.invalidated()
 			r.Invalid.Emit(req)
 			return
 		}
 
+		r.Metrics.validated()
 		req.Param = f
 
 		s.Emit(req)
@@ -398,7 +851,7 @@ func NewRoute(path string, buf int, ts int, fail Failure) *Route {
 
 //FromRoute returns a route based on a previous route
 func FromRoute(r *Route, path string) *Route {
-	return RawRoute(path, flux.DoPushSocket(r.Valid, func(v interface{}, s flux.SocketInterface) {
+	rs := RawRoute(path, flux.DoPushSocket(r.Valid, func(v interface{}, s flux.SocketInterface) {
 		req, ok := v.(*Request)
 
 		if !ok {
@@ -409,6 +862,14 @@ func FromRoute(r *Route, path string) *Route {
 
 		s.Emit(nreq)
 	}), flux.PushSocket(r.DTO), r.DTO, r.fail)
+
+	rs.retry = r.retry
+	rs.limit = r.limit
+	rs.priority = r.priority
+	rs.queue = r.queue
+	rs.parent = r
+	rs.names = r.names
+	return rs
 }
 
 //PatchRoute makes a route capable of creating PayloadRack route request
@@ -423,6 +884,13 @@ func PatchRoute(r *Route, f Failure) *Route {
 	return r
 }
 
+//RetryRoute sets the retry policy used by the PayloadRacks of a route and the
+//routes created from it after
+func RetryRoute(r *Route, retry *RetryPolicy) *Route {
+	r.retry = retry
+	return r
+}
+
 //InvertRoute returns a route based on a previous route rejection of a request
 //provides a divert like or not path logic (i.e if that path does not match the parent route)
 //then this gets validate that rejected route)
@@ -443,7 +911,14 @@ func InvertRoute(r *Route, path string, fail Failure) *Route {
 		fail = r.fail
 	}
 
-	return RawRoute(path, valids, flux.PushSocket(r.DTO), r.DTO, fail)
+	rs := RawRoute(path, valids, flux.PushSocket(r.DTO), r.DTO, fail)
+	rs.retry = r.retry
+	rs.limit = r.limit
+	rs.priority = r.priority
+	rs.queue = r.queue
+	rs.parent = r.parent
+	rs.names = r.names
+	return rs
 }
 
 //Serve takes a path and a payload value to be validated by the route
@@ -455,6 +930,18 @@ func (r *Route) Serve(path string, b interface{}, timeout int) {
 	r.ServeRequest(NewRequest(path, b, nil, timeout))
 }
 
+//ServePriority takes a path and a payload value to be validated by the route
+//with the giving priority for routes using priority delivery
+func (r *Route) ServePriority(path string, b interface{}, timeout int, priority int) {
+	if path == "" || path == "/" {
+		return
+	}
+
+	req := NewRequest(path, b, nil, timeout)
+	req.Priority = priority
+	r.ServeRequest(req)
+}
+
 //ServeRequest takes a *Request and validates its first path (i.e path[0])
 //if it matches then its validates it and sends off to its Valid socket or invalid
 //socket if invalid
@@ -1,8 +1,12 @@
 package servicedrop
 
 import (
+	"bytes"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/influx6/flux"
 )
@@ -164,3 +168,233 @@ func TestRouteMaker(t *testing.T) {
 	}
 
 }
+
+func TestRouteURL(t *testing.T) {
+	r := NewRoute("io", 2, 0, nil)
+
+	r.NewNamed("user.exec", `users/{id:[\d+]}/exec`)
+
+	if r.Named("user.exec") == nil {
+		t.Fatal("named route user.exec was not registered")
+	}
+
+	url, err := r.URL("user.exec", map[string]string{"id": "20"})
+
+	if err != nil {
+		t.Fatal("unable to build url for user.exec", err)
+	}
+
+	if url != "/io/users/20/exec" {
+		t.Fatalf("built url is incorrect: %s", url)
+	}
+
+	if _, err := r.URL("user.exec", map[string]string{"id": "bob"}); err == nil {
+		t.Fatal("url built with param not matching its pattern")
+	}
+
+	if _, err := r.URL("user.exec", nil); err == nil {
+		t.Fatal("url built with missing param")
+	}
+
+	if _, err := r.URL("user.shell", nil); err == nil {
+		t.Fatal("url built for unknown route name")
+	}
+}
+
+func TestRouteMetrics(t *testing.T) {
+	wait := new(sync.WaitGroup)
+	r := NewRoute("apple", 2, 0, nil)
+
+	r.Sub(func(r *Request, s *flux.Sub) {
+		wait.Done()
+	})
+
+	r.NotSub(func(r *Request, s *flux.Sub) {
+		wait.Done()
+	})
+
+	wait.Add(2)
+	r.Serve("apple", "red!", 0)
+	r.Serve("pear", "green!", 0)
+	wait.Wait()
+
+	if r.Metrics.Served != 2 || r.Metrics.Valid != 1 || r.Metrics.Invalid != 1 {
+		t.Fatalf("route metrics are incorrect: %+v", r.Metrics)
+	}
+
+	var buf bytes.Buffer
+
+	if err := WriteRouteMetrics(&buf, r); err != nil {
+		t.Fatal("unable to write route metrics", err)
+	}
+
+	if !strings.Contains(buf.String(), `servicedrop_route_requests_total{route="apple"} 2`) {
+		t.Fatalf("route metrics output is incorrect: %s", buf.String())
+	}
+}
+
+func TestRouteWithPayloadRetry(t *testing.T) {
+	released := make(chan interface{}, 1)
+	failed := make(chan interface{}, 1)
+
+	r := NewRoute("rack", 2, 3, func(fail flux.ActionInterface) {
+		fail.When(func(b interface{}, _ flux.ActionInterface) {
+			failed <- b
+		})
+	})
+
+	RetryRoute(r, &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	var offers int
+	var lock sync.Mutex
+
+	r.Sub(func(r *Request, s *flux.Sub) {
+		lock.Lock()
+		offers++
+		offer := offers
+		lock.Unlock()
+
+		if offer < 3 {
+			return
+		}
+
+		pk, ok := r.Payload.(*PayloadRack)
+
+		if !ok {
+			failed <- r.Payload
+			return
+		}
+
+		pk.Release().When(func(b interface{}, _ flux.ActionInterface) {
+			released <- b
+		})
+	})
+
+	r.Serve("rack", "red", 50)
+
+	select {
+	case b := <-released:
+		if b != "red" {
+			t.Fatal("request came back with incorrect payload", b)
+		}
+	case b := <-failed:
+		t.Fatal("payload failed before its retries were used", b)
+	case <-time.After(2 * time.Second):
+		t.Fatal("payload was never released")
+	}
+
+	if timeouts := atomic.LoadInt64(&r.Metrics.Timeouts); timeouts != 2 {
+		t.Fatalf("payload timed out %d times instead of 2", timeouts)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	retry := &RetryPolicy{MaxAttempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+
+	if d := retry.Delay(1); d != 10*time.Millisecond {
+		t.Fatalf("first delay is %s", d)
+	}
+
+	if d := retry.Delay(2); d != 20*time.Millisecond {
+		t.Fatalf("second delay is %s", d)
+	}
+
+	if d := retry.Delay(4); d != 30*time.Millisecond {
+		t.Fatalf("fourth delay is %s", d)
+	}
+
+	if retry.allows(5, nil) {
+		t.Fatal("retry allowed after max attempts")
+	}
+}
+
+func TestRouteServeReply(t *testing.T) {
+	r := NewRoute("apple", 2, 0, nil)
+
+	r.Sub(func(r *Request, s *flux.Sub) {
+		if r.ID == "" || !r.WantsReply() {
+			t.Fatal("request has no correlation id", r)
+		}
+
+		r.Reply("red!")
+		r.Reply("green!")
+	})
+
+	val, err := r.ServeReply("apple", "color?", 200).Wait()
+
+	if err != nil {
+		t.Fatal("request reply failed", err)
+	}
+
+	if val != "red!" {
+		t.Fatalf("request got incorrect reply: %+v", val)
+	}
+
+	_, err = r.ServeReply("pear", "color?", 20).Wait()
+
+	if err != ErrTimeout {
+		t.Fatal("unanswered request did not timeout", err)
+	}
+}
+
+func TestRouteScatter(t *testing.T) {
+	r := NewRoute("apple", 2, 0, nil)
+
+	r.Sub(func(r *Request, s *flux.Sub) {
+		r.Reply("red!")
+	})
+
+	r.Sub(func(r *Request, s *flux.Sub) {
+		r.Reply("green!")
+	})
+
+	r.Sub(func(r *Request, s *flux.Sub) {})
+
+	got := r.Scatter("apple", "color?", GatherOptions{Quorum: true, Timeout: 200})
+
+	if got.Err != nil {
+		t.Fatal("scatter failed to reach quorum", got.Err)
+	}
+
+	if len(got.Replies) != 2 {
+		t.Fatalf("scatter gathered incorrect replies: %+v", got.Replies)
+	}
+
+	got = r.Scatter("apple", "color?", GatherOptions{Timeout: 20})
+
+	if got.Err != ErrTimeout {
+		t.Fatal("scatter did not timeout waiting on all subscribers", got.Err)
+	}
+
+	if len(got.TimedOut) != 1 || got.TimedOut[0] != "apple#3" {
+		t.Fatalf("scatter reported incorrect timed out subscribers: %+v", got.TimedOut)
+	}
+
+	defer func(timeout int) { DefaultGatherTimeout = timeout }(DefaultGatherTimeout)
+	DefaultGatherTimeout = 20
+
+	got = r.Scatter("apple", "color?", GatherOptions{})
+
+	if got.Err != ErrTimeout {
+		t.Fatal("scatter without a timeout did not use the default", got.Err)
+	}
+
+	got = r.Scatter("apple", "color?", GatherOptions{Count: 3})
+
+	if got.Err != ErrTimeout {
+		t.Fatal("scatter with a count but no timeout did not use the default", got.Err)
+	}
+
+	silent := r.Sub(func(r *Request, s *flux.Sub) {})
+	r.Unsub(silent)
+
+	if subs := r.Subscribers(); len(subs) != 3 {
+		t.Fatalf("unsubscribed subscriber was not removed: %+v", subs)
+	}
+
+	got = r.Scatter("apple", "color?", GatherOptions{Count: 2})
+
+	if got.Err != nil || len(got.TimedOut) != 1 || got.TimedOut[0] != "apple#3" {
+		t.Fatalf("scatter waited on unsubscribed subscribers: %+v", got)
+	}
+}
@@ -0,0 +1,299 @@
+package servicedrop
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influx6/flux"
+)
+
+//OverloadPolicy decides what happens to requests served into a route whose
+//queue is full
+type OverloadPolicy int
+
+const (
+	//OverloadBlock blocks the emitter until the queue has room
+	OverloadBlock OverloadPolicy = iota
+	//OverloadDropNewest drops the request being served
+	OverloadDropNewest
+	//OverloadDropOldest drops the oldest request within the queue
+	OverloadDropOldest
+	//OverloadReject sends the request being served into the route Invalid socket
+	//with its Err set to ErrRouteOverload
+	OverloadReject
+)
+
+//ErrRouteOverload is set on requests rejected due to a full route queue
+var ErrRouteOverload = errors.New("route queue is full")
+
+//RouteLimit bounds the delivery of requests to the subscribers added with
+//Route.Sub, a limited route and its child routes share a single queue of
+//QueueSize requests handled by Concurrency goroutines so the limit bounds the
+//route tree as a whole rather than each route on its own, which lets a
+//RoutePriority order the requests of every route within the tree, the Policy
+//decides what happens once the queue is full, subscribers added with
+//Route.AllSub, Route.NotSub or directly to the Valid socket are not limited
+type RouteLimit struct {
+	Concurrency int
+	QueueSize   int
+	Policy      OverloadPolicy
+}
+
+//RoutePriority enables the delivery of higher priority requests first from the
+//queue shared by the routes, a request's priority is raised by one for every
+//Aging it waits within the queue so lower priority requests are not starved,
+//requests are only reordered while every goroutine of the limit is busy
+type RoutePriority struct {
+	Aging time.Duration
+}
+
+//DefaultPriorityLimit is used for routes with a RoutePriority but no RouteLimit,
+//its concurrency keeps slow handlers from holding up the other requests
+var DefaultPriorityLimit = &RouteLimit{16, 256, OverloadBlock}
+
+//routeSub is a subscriber added with Route.Sub
+type routeSub struct {
+	id      string
+	sub     *flux.Sub
+	handle  func(*Request, *flux.Sub)
+	metrics *RouteMetrics
+	queue   *routeQueue
+	closed  int32
+}
+
+//queuedRequest is a request waiting within a routeQueue for its subscriber
+type queuedRequest struct {
+	req *Request
+	sub *routeSub
+	fs  *flux.Sub
+	at  time.Time
+}
+
+//routeQueue is a bounded queue of requests shared by the subscribers of a
+//route tree, its workers run while the queue has subscribers
+type routeQueue struct {
+	items    []queuedRequest
+	size     int
+	workers  int
+	running  int
+	subs     int
+	policy   OverloadPolicy
+	priority *RoutePriority
+	lock     *sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+}
+
+func newRouteQueue(limit *RouteLimit, priority *RoutePriority) *routeQueue {
+	size := limit.QueueSize
+
+	if size <= 0 {
+		size = 1
+	}
+
+	workers := limit.Concurrency
+
+	if workers <= 0 {
+		workers = 1
+	}
+
+	q := &routeQueue{
+		items:    make([]queuedRequest, 0, size),
+		size:     size,
+		workers:  workers,
+		policy:   limit.Policy,
+		priority: priority,
+		lock:     new(sync.Mutex),
+	}
+
+	q.notEmpty = sync.NewCond(q.lock)
+	q.notFull = sync.NewCond(q.lock)
+	return q
+}
+
+//add registers a subscriber of the queue and starts the workers if needed
+func (q *routeQueue) add() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.subs++
+
+	for q.running < q.workers {
+		q.running++
+		go q.work()
+	}
+}
+
+//remove unregisters the subscriber and drops its queued requests, the workers
+//exit once the queue has no subscribers
+func (q *routeQueue) remove(rs *routeSub) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.subs--
+
+	items := q.items[:0]
+
+	for _, item := range q.items {
+		if item.sub == rs {
+			atomic.AddInt64(&rs.metrics.QueueDepth, -1)
+			continue
+		}
+		items = append(items, item)
+	}
+
+	q.items = items
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+//work handles the queued requests until the queue has no subscribers
+func (q *routeQueue) work() {
+	for {
+		item, ok := q.pop()
+
+		if !ok {
+			return
+		}
+
+		if atomic.LoadInt32(&item.sub.closed) != 0 {
+			continue
+		}
+
+		item.sub.handle(item.req, item.fs)
+	}
+}
+
+//push adds the request of the subscriber into the queue according to the
+//overload policy, it returns false if the request was not queued
+func (q *routeQueue) push(req *Request, rs *routeSub, fs *flux.Sub) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.items) >= q.size {
+		switch q.policy {
+		case OverloadDropNewest:
+			atomic.AddInt64(&rs.metrics.Dropped, 1)
+			return false
+		case OverloadReject:
+			atomic.AddInt64(&rs.metrics.Rejected, 1)
+			return false
+		case OverloadDropOldest:
+			oldest := q.items[0].sub.metrics
+			q.items = q.items[1:]
+			atomic.AddInt64(&oldest.Dropped, 1)
+			atomic.AddInt64(&oldest.QueueDepth, -1)
+		default:
+			for len(q.items) >= q.size {
+				q.notFull.Wait()
+			}
+		}
+	}
+
+	q.items = append(q.items, queuedRequest{req, rs, fs, time.Now()})
+	atomic.AddInt64(&rs.metrics.QueueDepth, 1)
+	q.notEmpty.Signal()
+	return true
+}
+
+//pop waits for and removes the next request from the queue, it returns false
+//once the queue is empty and has no subscribers
+func (q *routeQueue) pop() (queuedRequest, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.items) <= 0 {
+		if q.subs <= 0 {
+			q.running--
+			return queuedRequest{}, false
+		}
+
+		q.notEmpty.Wait()
+	}
+
+	index := q.next()
+	item := q.items[index]
+	q.items = append(q.items[:index], q.items[index+1:]...)
+
+	atomic.AddInt64(&item.sub.metrics.QueueDepth, -1)
+	q.notFull.Signal()
+	return item, true
+}
+
+//next returns the index of the request to be delivered next, which is the
+//oldest of the requests with the highest aged priority
+func (q *routeQueue) next() int {
+	if q.priority == nil {
+		return 0
+	}
+
+	now := time.Now()
+	index, best := 0, 0
+
+	for i, item := range q.items {
+		pr := item.req.Priority
+
+		if q.priority.Aging > 0 {
+			pr += int(now.Sub(item.at) / q.priority.Aging)
+		}
+
+		if i == 0 || pr > best {
+			index, best = i, pr
+		}
+	}
+
+	return index
+}
+
+//PriorityRoute sets the priority delivery used for the subscribers of the route
+//and of its child routes, including those created after, which then share a new
+//queue, subscribers added before the call keep their previous delivery
+func PriorityRoute(r *Route, priority *RoutePriority) *Route {
+	setRouteQueue(r, r.limit, priority, routeQueueOf(r.limit, priority))
+	return r
+}
+
+//LimitRoute sets the limit used for the subscribers of the route and of its
+//child routes, including those created after, which then share a new queue,
+//subscribers added before the call keep their previous delivery
+func LimitRoute(r *Route, limit *RouteLimit) *Route {
+	setRouteQueue(r, limit, r.priority, routeQueueOf(limit, r.priority))
+	return r
+}
+
+//setRouteQueue sets the limit, priority and queue of the route and of its
+//child routes
+func setRouteQueue(r *Route, limit *RouteLimit, priority *RoutePriority, queue *routeQueue) {
+	r.lock.Lock()
+	r.limit = limit
+	r.priority = priority
+	r.queue = queue
+
+	children := make([]*Route, 0, len(r.childRoutes))
+
+	for _, child := range r.childRoutes {
+		children = append(children, child)
+	}
+
+	r.lock.Unlock()
+
+	for _, child := range children {
+		setRouteQueue(child, limit, priority, queue)
+	}
+}
+
+//routeQueueOf returns the queue for the limit and priority or nil if neither
+//is set
+func routeQueueOf(limit *RouteLimit, priority *RoutePriority) *routeQueue {
+	if limit == nil && priority != nil {
+		limit = DefaultPriorityLimit
+	}
+
+	if limit == nil {
+		return nil
+	}
+
+	return newRouteQueue(limit, priority)
+}
@@ -0,0 +1,263 @@
+package servicedrop
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+)
+
+func TestRouteQueueDropNewest(t *testing.T) {
+	metrics := NewRouteMetrics()
+	q, sub := newRouteQueue(&RouteLimit{1, 2, OverloadDropNewest}, nil), &routeSub{metrics: metrics}
+
+	for _, path := range []string{"a", "b", "c"} {
+		q.push(NewRequest(path, nil, nil, 0), sub, nil)
+	}
+
+	if metrics.Dropped != 1 || metrics.QueueDepth != 2 {
+		t.Fatalf("queue metrics are incorrect: %+v", metrics)
+	}
+
+	if item, _ := q.pop(); item.req.Path != "a" {
+		t.Fatalf("queue returned %s instead of a", item.req.Path)
+	}
+}
+
+func TestRouteQueueDropOldest(t *testing.T) {
+	metrics := NewRouteMetrics()
+	q, sub := newRouteQueue(&RouteLimit{1, 2, OverloadDropOldest}, nil), &routeSub{metrics: metrics}
+
+	for _, path := range []string{"a", "b", "c"} {
+		q.push(NewRequest(path, nil, nil, 0), sub, nil)
+	}
+
+	if item, _ := q.pop(); item.req.Path != "b" {
+		t.Fatalf("queue returned %s instead of b", item.req.Path)
+	}
+
+	if metrics.Dropped != 1 || metrics.QueueDepth != 1 {
+		t.Fatalf("queue metrics are incorrect: %+v", metrics)
+	}
+}
+
+func TestRouteQueueReject(t *testing.T) {
+	metrics := NewRouteMetrics()
+	q, sub := newRouteQueue(&RouteLimit{1, 1, OverloadReject}, nil), &routeSub{metrics: metrics}
+
+	if !q.push(NewRequest("a", nil, nil, 0), sub, nil) {
+		t.Fatal("queue rejected request with room")
+	}
+
+	if q.push(NewRequest("b", nil, nil, 0), sub, nil) {
+		t.Fatal("queue accepted request when full")
+	}
+
+	if metrics.Rejected != 1 {
+		t.Fatalf("queue metrics are incorrect: %+v", metrics)
+	}
+}
+
+func TestRouteQueueBlock(t *testing.T) {
+	q, sub := newRouteQueue(&RouteLimit{1, 1, OverloadBlock}, nil), &routeSub{metrics: NewRouteMetrics()}
+	q.push(NewRequest("a", nil, nil, 0), sub, nil)
+
+	pushed := make(chan struct{})
+
+	go func() {
+		q.push(NewRequest("b", nil, nil, 0), sub, nil)
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("queue did not block when full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	q.pop()
+
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("queue did not unblock once it had room")
+	}
+}
+
+func TestRouteQueuePriority(t *testing.T) {
+	q, sub := newRouteQueue(&RouteLimit{1, 4, OverloadBlock}, &RoutePriority{time.Hour}), &routeSub{metrics: NewRouteMetrics()}
+
+	for i, path := range []string{"exec", "window-change", "shell"} {
+		req := NewRequest(path, nil, nil, 0)
+		if i == 1 {
+			req.Priority = 10
+		}
+		q.push(req, sub, nil)
+	}
+
+	for _, path := range []string{"window-change", "exec", "shell"} {
+		if item, _ := q.pop(); item.req.Path != path {
+			t.Fatalf("queue returned %s instead of %s", item.req.Path, path)
+		}
+	}
+}
+
+func TestRouteQueuePriorityAging(t *testing.T) {
+	q, sub := newRouteQueue(&RouteLimit{1, 4, OverloadBlock}, &RoutePriority{5 * time.Millisecond}), &routeSub{metrics: NewRouteMetrics()}
+
+	q.push(NewRequest("exec", nil, nil, 0), sub, nil)
+	time.Sleep(30 * time.Millisecond)
+
+	probe := NewRequest("probe", nil, nil, 0)
+	probe.Priority = 2
+	q.push(probe, sub, nil)
+
+	if item, _ := q.pop(); item.req.Path != "exec" {
+		t.Fatalf("aged request was starved by %s", item.req.Path)
+	}
+}
+
+//waitQueueDepth waits until the requests queued across the routes reach the depth
+func waitQueueDepth(t *testing.T, depth int64, routes ...*Route) {
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		var queued int64
+
+		for _, r := range routes {
+			queued += atomic.LoadInt64(&r.Metrics.QueueDepth)
+		}
+
+		if queued == depth {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d requests queued across the routes, got %d", depth, queued)
+		}
+
+		<-time.After(5 * time.Millisecond)
+	}
+}
+
+func TestLimitRoute(t *testing.T) {
+	r := NewRoute("io", 0, -1, nil)
+
+	//routes created before the limit share it with those created after
+	exec := r.New("exec")
+	LimitRoute(r, &RouteLimit{2, 16, OverloadBlock})
+	shell := r.New("shell")
+
+	var running, peak int32
+	release := make(chan struct{})
+	handled := make(chan string, 16)
+
+	handler := func(req *Request, _ *flux.Sub) {
+		n := atomic.AddInt32(&running, 1)
+
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		<-release
+		atomic.AddInt32(&running, -1)
+		handled <- req.Path
+	}
+
+	exec.Sub(handler)
+	sub := shell.Sub(handler)
+
+	for i := 0; i < 3; i++ {
+		r.Serve("io/exec", nil, 0)
+		r.Serve("io/shell", nil, 0)
+	}
+
+	//both workers hold a request before the rest are counted as queued
+	for deadline := time.Now().Add(2 * time.Second); atomic.LoadInt32(&running) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("workers did not take the first requests")
+		}
+		<-time.After(5 * time.Millisecond)
+	}
+
+	waitQueueDepth(t, 4, exec, shell)
+
+	shell.Unsub(sub)
+
+	if depth := atomic.LoadInt64(&shell.Metrics.QueueDepth); depth != 0 || len(shell.Subscribers()) != 0 {
+		t.Fatal("expected unsubscribed requests to be dropped", depth, shell.Subscribers())
+	}
+
+	close(release)
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("queued requests were not handled")
+		}
+	}
+
+	select {
+	case path := <-handled:
+		t.Fatal("request handled after its subscriber was removed", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if n := atomic.LoadInt32(&peak); n != 2 {
+		t.Fatalf("expected the routes to share 2 workers, peaked at %d", n)
+	}
+}
+
+func TestPriorityRoute(t *testing.T) {
+	r := NewRoute("io", 0, -1, nil)
+	LimitRoute(r, &RouteLimit{1, 16, OverloadBlock})
+	PriorityRoute(r, &RoutePriority{time.Hour})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handled := make(chan string, 4)
+
+	exec := r.New("session/exec")
+	exec.Sub(func(req *Request, _ *flux.Sub) {
+		if req.Payload == "first" {
+			close(started)
+			<-release
+		}
+		handled <- req.Path
+	})
+
+	change := r.New("session/window-change")
+	change.Sub(func(req *Request, _ *flux.Sub) {
+		handled <- req.Path
+	})
+
+	r.Serve("io/session/exec", "first", 0)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("first request was not handled")
+	}
+
+	r.Serve("io/session/exec", "second", 0)
+	r.ServePriority("io/session/window-change", nil, 0, RequestPriorities["window-change"])
+
+	//the worker is only released once both requests wait within the queue
+	waitQueueDepth(t, 2, exec, change)
+	close(release)
+
+	for _, path := range []string{"io/session/exec", "io/session/window-change", "io/session/exec"} {
+		select {
+		case got := <-handled:
+			if got != path {
+				t.Fatalf("expected %s to be handled, got %s", path, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("queued requests were not handled")
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package servicedrop
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//DefaultLatencyBuckets are the upper bounds in seconds used by the route
+//handler latency histograms
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+//RouteMetrics records the requests flowing through a single route, QueueDepth,
+//Dropped and Rejected are only recorded for routes with a RouteLimit
+type RouteMetrics struct {
+	Served     int64
+	Valid      int64
+	Invalid    int64
+	Timeouts   int64
+	Failures   int64
+	Dropped    int64
+	Rejected   int64
+	QueueDepth int64
+	Latency    *Histogram
+}
+
+//NewRouteMetrics returns a new RouteMetrics using the DefaultLatencyBuckets
+func NewRouteMetrics() *RouteMetrics {
+	return &RouteMetrics{
+		Latency: NewHistogram(DefaultLatencyBuckets),
+	}
+}
+
+func (m *RouteMetrics) served() {
+	atomic.AddInt64(&m.Served, 1)
+}
+
+func (m *RouteMetrics) validated() {
+	atomic.AddInt64(&m.Valid, 1)
+}
+
+func (m *RouteMetrics) invalidated() {
+	atomic.AddInt64(&m.Invalid, 1)
+}
+
+func (m *RouteMetrics) timedOut() {
+	atomic.AddInt64(&m.Timeouts, 1)
+}
+
+func (m *RouteMetrics) failed() {
+	atomic.AddInt64(&m.Failures, 1)
+}
+
+func (m *RouteMetrics) observe(d time.Duration) {
+	m.Latency.Observe(d.Seconds())
+}
+
+//Histogram records observations into a set of buckets by their upper bounds
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+	lock   *sync.Mutex
+}
+
+//NewHistogram returns a histogram with the giving bucket upper bounds
+func NewHistogram(bounds []float64) *Histogram {
+	bs := append([]float64(nil), bounds...)
+	sort.Float64s(bs)
+
+	return &Histogram{
+		bs,
+		make([]uint64, len(bs)),
+		0,
+		0,
+		new(sync.Mutex),
+	}
+}
+
+//Observe adds a value into the histogram
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.sum += v
+	h.count++
+
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+//Snapshot returns the bucket bounds with their cumulative counts, the sum
+//and the total count of observations
+func (h *Histogram) Snapshot() ([]float64, []uint64, float64, uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	cum := make([]uint64, len(h.counts))
+
+	var total uint64
+	for i, c := range h.counts {
+		total += c
+		cum[i] = total
+	}
+
+	return h.bounds, cum, h.sum, h.count
+}
+
+//labelEscaper escapes label values for the prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//WriteRouteMetrics writes the metrics of every route within the route tree in
+//the prometheus text exposition format
+func WriteRouteMetrics(w io.Writer, r *Route) error {
+	var routes []*Route
+
+	r.Walk(func(rs *Route) {
+		routes = append(routes, rs)
+	})
+
+	sort.Sort(routesByPath(routes))
+
+	bw := bufio.NewWriter(w)
+
+	counters := []struct {
+		name string
+		help string
+		val  func(*RouteMetrics) int64
+	}{
+		{"servicedrop_route_requests_total", "Requests served into the route.", func(m *RouteMetrics) int64 { return atomic.LoadInt64(&m.Served) }},
+		{"servicedrop_route_valid_total", "Requests matching the route pattern.", func(m *RouteMetrics) int64 { return atomic.LoadInt64(&m.Valid) }},
+		{"servicedrop_route_invalid_total", "Requests not matching the route pattern.", func(m *RouteMetrics) int64 { return atomic.LoadInt64(&m.Invalid) }},
+		{"servicedrop_route_timeouts_total", "PayloadRack timeouts of requests to the route.", func(m *RouteMetrics) int64 { return atomic.LoadInt64(&m.Timeouts) }},
+		{"servicedrop_route_failures_total", "PayloadRack failures of requests to the route.", func(m *RouteMetrics) int64 { return atomic.LoadInt64(&m.Failures) }},
+		{"servicedrop_route_dropped_total", "Requests dropped due to a full route queue.", func(m *RouteMetrics) int64 { return atomic.LoadInt64(&m.Dropped) }},
+		{"servicedrop_route_rejected_total", "Requests rejected due to a full route queue.", func(m *RouteMetrics) int64 { return atomic.LoadInt64(&m.Rejected) }},
+	}
+
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, rs := range routes {
+			fmt.Fprintf(bw, "%s{route=\"%s\"} %d\n", c.name, labelEscaper.Replace(rs.FullPath()), c.val(rs.Metrics))
+		}
+	}
+
+	depth := "servicedrop_route_queue_depth"
+	fmt.Fprintf(bw, "# HELP %s Requests waiting within the route queues.\n# TYPE %s gauge\n", depth, depth)
+
+	for _, rs := range routes {
+		fmt.Fprintf(bw, "%s{route=\"%s\"} %d\n", depth, labelEscaper.Replace(rs.FullPath()), atomic.LoadInt64(&rs.Metrics.QueueDepth))
+	}
+
+	name := "servicedrop_route_handler_seconds"
+	fmt.Fprintf(bw, "# HELP %s Time taken by route handlers.\n# TYPE %s histogram\n", name, name)
+
+	for _, rs := range routes {
+		label := labelEscaper.Replace(rs.FullPath())
+		bounds, counts, sum, count := rs.Metrics.Latency.Snapshot()
+
+		for i, b := range bounds {
+			fmt.Fprintf(bw, "%s_bucket{route=\"%s\",le=\"%g\"} %d\n", name, label, b, counts[i])
+		}
+
+		fmt.Fprintf(bw, "%s_bucket{route=\"%s\",le=\"+Inf\"} %d\n", name, label, count)
+		fmt.Fprintf(bw, "%s_sum{route=\"%s\"} %g\n", name, label, sum)
+		fmt.Fprintf(bw, "%s_count{route=\"%s\"} %d\n", name, label, count)
+	}
+
+	return bw.Flush()
+}
+
+//RouteMetricsHandler returns a http.Handler serving the metrics of the route
+//tree in the prometheus text exposition format
+func RouteMetricsHandler(r *Route) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteRouteMetrics(res, r)
+	})
+}
+
+//routesByPath sorts routes by their full path
+type routesByPath []*Route
+
+func (r routesByPath) Len() int           { return len(r) }
+func (r routesByPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r routesByPath) Less(i, j int) bool { return r[i].FullPath() < r[j].FullPath() }
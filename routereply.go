@@ -0,0 +1,249 @@
+package servicedrop
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+//ErrNoSubscribers is returned when a scattered request has no subscribers to reach
+var ErrNoSubscribers = errors.New("route has no subscribers")
+
+//replier receives the replies made to a request
+type replier interface {
+	reply(*Request, interface{}) bool
+}
+
+//Reply answers a request served with Route.ServeReply, it returns false if
+//the request expects no reply or was already answered
+func (r *Request) Reply(v interface{}) bool {
+	if r.replies == nil {
+		return false
+	}
+
+	return r.replies.reply(r, v)
+}
+
+//WantsReply returns true if the request was served expecting a reply
+func (r *Request) WantsReply() bool {
+	return r.replies != nil
+}
+
+//RouteReply is the future of a request served with Route.ServeReply which is
+//resolved with the first reply or ErrTimeout
+type RouteReply struct {
+	ID    string
+	value interface{}
+	err   error
+	done  chan struct{}
+	once  *sync.Once
+}
+
+//NewRouteReply returns a new reply future with a new correlation id
+func NewRouteReply() *RouteReply {
+	return &RouteReply{
+		uuid.New(),
+		nil,
+		nil,
+		make(chan struct{}),
+		new(sync.Once),
+	}
+}
+
+//reply resolves the future with the first reply
+func (f *RouteReply) reply(_ *Request, v interface{}) bool {
+	return f.resolve(v, nil)
+}
+
+//resolve sets the value or error of the future once
+func (f *RouteReply) resolve(v interface{}, err error) bool {
+	var ok bool
+
+	f.once.Do(func() {
+		f.value = v
+		f.err = err
+		ok = true
+		close(f.done)
+	})
+
+	return ok
+}
+
+//Done returns a channel closed once the future is resolved
+func (f *RouteReply) Done() <-chan struct{} {
+	return f.done
+}
+
+//Wait blocks until the future is resolved and returns the reply or the error
+func (f *RouteReply) Wait() (interface{}, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+//ServeReply serves the path and payload into the route as a request bound to
+//a new RouteReply, the timeout in milliseconds is used for both the request and
+//the reply, if its zero or less the route's timeout is used instead and with
+//neither set the reply waits until answered
+func (r *Route) ServeReply(path string, b interface{}, timeout int) *RouteReply {
+	future := NewRouteReply()
+
+	req := NewRequest(path, b, nil, timeout)
+	req.ID = future.ID
+	req.replies = future
+
+	wait := timeout
+	if wait <= 0 {
+		wait = r.DTO
+	}
+
+	if wait > 0 {
+		time.AfterFunc(time.Duration(wait)*time.Millisecond, func() {
+			future.resolve(nil, ErrTimeout)
+		})
+	}
+
+	r.ServeRequest(req)
+	return future
+}
+
+//DefaultGatherTimeout is the deadline in milliseconds of scattered requests
+//without a Timeout
+var DefaultGatherTimeout = 5000
+
+//GatherOptions decides when a scattered request stops collecting replies,
+//Count stops after that many replies, Quorum after a majority of the subscribers
+//replied and Timeout in milliseconds after the deadline which is the
+//DefaultGatherTimeout if it is not set, with no Count or Quorum every
+//subscriber's reply is waited for
+type GatherOptions struct {
+	Count   int
+	Quorum  bool
+	Timeout int
+}
+
+//Gathered contains the replies of a scattered request by the subscriber ids
+//which made them and the subscribers which had not replied when gathering
+//stopped, Err is ErrTimeout if the deadline passed before enough replies
+type Gathered struct {
+	ID       string
+	Replies  map[string]interface{}
+	TimedOut []string
+	Err      error
+}
+
+//gatherer collects the replies of a scattered request
+type gatherer struct {
+	expect  map[string]bool
+	replies map[string]interface{}
+	need    int
+	closed  bool
+	done    chan struct{}
+	lock    *sync.Mutex
+}
+
+//reply adds the reply of an expected subscriber once
+func (g *gatherer) reply(req *Request, v interface{}) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.closed || !g.expect[req.sub] {
+		return false
+	}
+
+	if _, ok := g.replies[req.sub]; ok {
+		return false
+	}
+
+	g.replies[req.sub] = v
+
+	if len(g.replies) >= g.need {
+		g.closed = true
+		close(g.done)
+	}
+
+	return true
+}
+
+//Scatter serves the path and payload as a request to every subscriber of the
+//route matching the path and gathers their replies according to the options
+func (r *Route) Scatter(path string, b interface{}, opts GatherOptions) *Gathered {
+	future := NewRouteReply()
+	result := &Gathered{ID: future.ID, Replies: make(map[string]interface{})}
+
+	target := r.Match(splitPatternAndRemovePrefix(path))
+
+	if target == nil {
+		result.Err = ErrNoSubscribers
+		return result
+	}
+
+	subs := target.Subscribers()
+
+	if len(subs) <= 0 {
+		result.Err = ErrNoSubscribers
+		return result
+	}
+
+	need := len(subs)
+
+	if opts.Count > 0 && opts.Count < need {
+		need = opts.Count
+	}
+
+	if quorum := len(subs)/2 + 1; opts.Quorum && quorum < need {
+		need = quorum
+	}
+
+	g := &gatherer{
+		make(map[string]bool),
+		result.Replies,
+		need,
+		false,
+		make(chan struct{}),
+		new(sync.Mutex),
+	}
+
+	for _, id := range subs {
+		g.expect[id] = true
+	}
+
+	//subscribers which never reply must not hold up the gathering forever
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultGatherTimeout
+	}
+
+	req := NewRequest(path, b, nil, opts.Timeout)
+	req.ID = future.ID
+	req.replies = g
+
+	var deadline <-chan time.Time
+
+	if opts.Timeout > 0 {
+		deadline = time.After(time.Duration(opts.Timeout) * time.Millisecond)
+	}
+
+	r.ServeRequest(req)
+
+	select {
+	case <-g.done:
+	case <-deadline:
+		result.Err = ErrTimeout
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.closed = true
+
+	for _, id := range subs {
+		if _, ok := g.replies[id]; !ok {
+			result.TimedOut = append(result.TimedOut, id)
+		}
+	}
+
+	sort.Strings(result.TimedOut)
+	return result
+}
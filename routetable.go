@@ -0,0 +1,438 @@
+package servicedrop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/influx6/flux"
+)
+
+//RouteTable describes a route tree with its timeouts, failure and behaviours
+//which can be loaded from a json file eg.
+//
+//	{
+//		"service": "io",
+//		"buffer": 0,
+//		"timeout": 60,
+//		"fail": "log",
+//		"routes": [
+//			{"path": "session/exec", "behaviours": ["exec"]},
+//			{"path": "session/shell", "timeout": 200, "fail": "refuse", "behaviours": ["shell"]}
+//		]
+//	}
+type RouteTable struct {
+	Service string        `json:"service"`
+	Buffer  int           `json:"buffer"`
+	Timeout int           `json:"timeout"`
+	Fail    string        `json:"fail"`
+	Routes  []*RouteEntry `json:"routes"`
+	lines   map[string]int
+}
+
+//RouteEntry describes a single route within a RouteTable, the path is relative
+//to the root route of the table
+type RouteEntry struct {
+	Path       string   `json:"path"`
+	Name       string   `json:"name"`
+	Timeout    int      `json:"timeout"`
+	Fail       string   `json:"fail"`
+	Behaviours []string `json:"behaviours"`
+	Line       int      `json:"-"`
+}
+
+//RouteTableError reports an error within a route table file along with the
+//line it was found on
+type RouteTableError struct {
+	Line int
+	Err  string
+}
+
+//Error returns the error message with its line
+func (e *RouteTableError) Error() string {
+	return fmt.Sprintf("route table: line %d: %s", e.Line, e.Err)
+}
+
+//RouteFailures provides the failure behaviours which a RouteTable can use by name
+var RouteFailures = map[string]Failure{
+	"discard": func(act flux.ActionInterface) {
+		act.When(func(data interface{}, _ flux.ActionInterface) {})
+	},
+	"log": func(act flux.ActionInterface) {
+		act.When(func(data interface{}, _ flux.ActionInterface) {
+			log.Printf("Route payload failed: %+v", data)
+		})
+	},
+	"refuse": func(act flux.ActionInterface) {
+		act.When(func(data interface{}, _ flux.ActionInterface) {
+			cpay, ok := data.(*ChannelPayload)
+
+			if !ok {
+				return
+			}
+
+			cpay.Do.Do(func() {
+				if cpay.Req.WantReply {
+					cpay.Req.Reply(false, nil)
+				}
+			})
+		})
+	},
+}
+
+//RouteBehaviours provides the behaviours which a RouteTable can attach to routes by name
+var RouteBehaviours = map[string]func(*Route){
+	"refuse":        AddRefusalRouteBehaviour,
+	"redirect":      AddRedirectRouteBehaviour,
+	"exec":          AddExecRouteBehaviour,
+	"pty":           AddPtyRouteBehaviour,
+	"shell":         AddShellRouteBehaviour,
+	"window-change": AddWindowChangeRouteBehaviour,
+	"env":           AddEnvRouteBehaviour,
+	"signal":        AddSignalRouteBehaviour,
+}
+
+//LoadRouteTable reads and validates a route table from a json file
+func LoadRouteTable(file string) (*RouteTable, error) {
+	fs, err := os.Open(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fs.Close()
+
+	return ParseRouteTable(fs)
+}
+
+//ParseRouteTable reads and validates a route table from a reader
+func ParseRouteTable(r io.Reader) (*RouteTable, error) {
+	data, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	table := new(RouteTable)
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(table); err != nil {
+		switch ex := err.(type) {
+		case *json.SyntaxError:
+			return nil, &RouteTableError{lineAt(data, ex.Offset), ex.Error()}
+		case *json.UnmarshalTypeError:
+			return nil, &RouteTableError{lineAt(data, ex.Offset), ex.Error()}
+		}
+
+		//unknown fields are reported without an offset so the keys are walked
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return nil, &RouteTableError{unknownFieldLine(data), err.Error()}
+		}
+
+		return nil, err
+	}
+
+	if err := table.locate(data); err != nil {
+		return nil, err
+	}
+
+	if err := table.validate(); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+//locate finds the lines of the table keys and of each route entry
+func (t *RouteTable) locate(data []byte) error {
+	t.lines = make(map[string]int)
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		line := tokenLine(data, dec.InputOffset())
+		tk, err := dec.Token()
+
+		if err != nil {
+			return err
+		}
+
+		key, _ := tk.(string)
+		key = strings.ToLower(key)
+		t.lines[key] = line
+
+		if key != "routes" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if tk, err = dec.Token(); err != nil {
+			return err
+		}
+
+		if tk == nil {
+			continue
+		}
+
+		for i := 0; dec.More(); i++ {
+			line := tokenLine(data, dec.InputOffset())
+
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+
+			if i < len(t.Routes) && t.Routes[i] != nil {
+				t.Routes[i].Line = line
+			}
+		}
+
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//validate checks the route table for unknown failures, behaviours, timeouts
+//without a fail behaviour and repeated route names
+func (t *RouteTable) validate() error {
+	if t.Fail != "" {
+		if _, ok := RouteFailures[t.Fail]; !ok {
+			return &RouteTableError{t.lines["fail"], fmt.Sprintf("unknown fail behaviour %q", t.Fail)}
+		}
+	}
+
+	names := make(map[string]int)
+
+	for _, en := range t.Routes {
+		if en == nil {
+			return &RouteTableError{t.lines["routes"], "route entry can not be null"}
+		}
+
+		if en.Path == "" {
+			return &RouteTableError{en.Line, "route path can not be empty"}
+		}
+
+		if en.Timeout < -1 {
+			return &RouteTableError{en.Line, fmt.Sprintf("invalid timeout %d for %q", en.Timeout, en.Path)}
+		}
+
+		if en.Fail != "" {
+			if _, ok := RouteFailures[en.Fail]; !ok {
+				return &RouteTableError{en.Line, fmt.Sprintf("unknown fail behaviour %q for %q", en.Fail, en.Path)}
+			}
+		}
+
+		//timeouts only take effect on routes with a fail behaviour
+		if en.Timeout != 0 && en.Fail == "" && t.Fail == "" {
+			return &RouteTableError{en.Line, fmt.Sprintf("timeout for %q requires a fail behaviour", en.Path)}
+		}
+
+		for _, bh := range en.Behaviours {
+			if _, ok := RouteBehaviours[bh]; !ok {
+				return &RouteTableError{en.Line, fmt.Sprintf("unknown behaviour %q for %q", bh, en.Path)}
+			}
+		}
+
+		if en.Name == "" {
+			continue
+		}
+
+		if line, ok := names[en.Name]; ok {
+			return &RouteTableError{en.Line, fmt.Sprintf("route name %q already used on line %d", en.Name, line)}
+		}
+
+		names[en.Name] = en.Line
+	}
+
+	return nil
+}
+
+//Config returns a RouteConfig using the table buffer, timeout and fail behaviour
+func (t *RouteTable) Config() *RouteConfig {
+	return NewRouteConfig(t.Buffer, t.Timeout, RouteFailures[t.Fail])
+}
+
+//Build creates the routes of the table within the giving route and attaches
+//their timeouts, failures and behaviours
+func (t *RouteTable) Build(r *Route) error {
+	for _, en := range t.Routes {
+		var rs *Route
+
+		if en.Name != "" {
+			rs = r.NewNamed(en.Name, en.Path)
+		} else {
+			rs = r.New(en.Path)
+		}
+
+		if en.Timeout != 0 {
+			rs.DTO = en.Timeout
+		}
+
+		if en.Fail != "" {
+			rs.fail = RouteFailures[en.Fail]
+		}
+
+		for _, bh := range en.Behaviours {
+			fx, ok := RouteBehaviours[bh]
+
+			if !ok {
+				return &RouteTableError{en.Line, fmt.Sprintf("unknown behaviour %q for %q", bh, en.Path)}
+			}
+
+			fx(rs)
+		}
+	}
+
+	return nil
+}
+
+//unknownFieldLine returns the line of the first key of the table or of its
+//route entries which is not one of their fields
+func unknownFieldLine(data []byte) int {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if tk, err := dec.Token(); err != nil || tk != json.Delim('{') {
+		return 0
+	}
+
+	table, entry := jsonFields(RouteTable{}), jsonFields(RouteEntry{})
+
+	for dec.More() {
+		line := tokenLine(data, dec.InputOffset())
+		tk, err := dec.Token()
+
+		if err != nil {
+			return 0
+		}
+
+		key, _ := tk.(string)
+
+		if !hasField(table, key) {
+			return line
+		}
+
+		if !strings.EqualFold(key, "routes") {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return 0
+			}
+			continue
+		}
+
+		if tk, err = dec.Token(); err != nil || tk != json.Delim('[') {
+			return 0
+		}
+
+		for dec.More() {
+			if tk, err = dec.Token(); err != nil {
+				return 0
+			}
+
+			//null entries have no keys
+			if tk == nil {
+				continue
+			}
+
+			if tk != json.Delim('{') {
+				return 0
+			}
+
+			for dec.More() {
+				line := tokenLine(data, dec.InputOffset())
+				tk, err := dec.Token()
+
+				if err != nil {
+					return 0
+				}
+
+				if key, _ := tk.(string); !hasField(entry, key) {
+					return line
+				}
+
+				var skip json.RawMessage
+				if err := dec.Decode(&skip); err != nil {
+					return 0
+				}
+			}
+
+			if _, err := dec.Token(); err != nil {
+				return 0
+			}
+		}
+
+		if _, err := dec.Token(); err != nil {
+			return 0
+		}
+	}
+
+	return 0
+}
+
+//jsonFields returns the json keys of the fields of the struct
+func jsonFields(v interface{}) []string {
+	var fields []string
+
+	tp := reflect.TypeOf(v)
+
+	for i := 0; i < tp.NumField(); i++ {
+		name := strings.Split(tp.Field(i).Tag.Get("json"), ",")[0]
+
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+
+	return fields
+}
+
+//hasField returns true if the key matches one of the fields, as encoding/json
+//does keys are matched without case
+func hasField(fields []string, key string) bool {
+	for _, field := range fields {
+		if strings.EqualFold(field, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//lineAt returns the line of the giving offset
+func lineAt(data []byte, offset int64) int {
+	off := int(offset)
+
+	if off > len(data) {
+		off = len(data)
+	}
+
+	return bytes.Count(data[:off], []byte("\n")) + 1
+}
+
+//tokenLine returns the line of the first token at or after the giving offset
+func tokenLine(data []byte, offset int64) int {
+	off := offset
+
+	for int(off) < len(data) && strings.IndexByte(" \t\r\n,:", data[off]) != -1 {
+		off++
+	}
+
+	return lineAt(data, off)
+}
@@ -0,0 +1,175 @@
+package servicedrop
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+)
+
+func TestRouteTable(t *testing.T) {
+	table, err := ParseRouteTable(strings.NewReader(`{
+	"service": "io",
+	"timeout": 60,
+	"fail": "log",
+	"routes": [
+		{"path": "session/exec", "name": "exec", "behaviours": ["exec"]},
+		{"path": "session/shell", "timeout": 200, "fail": "refuse", "behaviours": ["pty", "shell"]}
+	]
+}`))
+
+	if err != nil {
+		t.Fatal("unable to parse route table", err)
+	}
+
+	if table.Routes[1].Line != 7 {
+		t.Fatalf("route entry has incorrect line %d", table.Routes[1].Line)
+	}
+
+	rc := table.Config()
+	r := NewRoute(table.Service, rc.buffer, rc.timeout, rc.fail)
+
+	if err := table.Build(r); err != nil {
+		t.Fatal("unable to build route table", err)
+	}
+
+	if r.Named("exec") == nil {
+		t.Fatal("named route exec was not created")
+	}
+
+	shell := r.Child("session/shell")
+
+	if shell == nil {
+		t.Fatal("route session/shell was not created")
+	}
+
+	if shell.DTO != 200 {
+		t.Fatalf("route session/shell has incorrect timeout %d", shell.DTO)
+	}
+}
+
+func TestRouteTableErrors(t *testing.T) {
+	_, err := ParseRouteTable(strings.NewReader(`{
+	"service": "io",
+	"routes": [
+		{"path": "session/exec"},
+		{"path": "session/shell", "behaviours": ["dance"]}
+	]
+}`))
+
+	ex, ok := err.(*RouteTableError)
+
+	if !ok {
+		t.Fatal("unknown behaviour was not reported", err)
+	}
+
+	if ex.Line != 5 {
+		t.Fatalf("unknown behaviour reported on line %d", ex.Line)
+	}
+
+	_, err = ParseRouteTable(strings.NewReader(`{
+	"service": "io",
+	"routes": [
+		{"path": "session/exec",}
+	]
+}`))
+
+	ex, ok = err.(*RouteTableError)
+
+	if !ok {
+		t.Fatal("syntax error was not reported", err)
+	}
+
+	if ex.Line != 4 {
+		t.Fatalf("syntax error reported on line %d", ex.Line)
+	}
+
+	_, err = ParseRouteTable(strings.NewReader(`{
+	"service": "io",
+	"routes": [
+		{"path": "session/exec",
+			"behaviors": ["exec"]}
+	]
+}`))
+
+	ex, ok = err.(*RouteTableError)
+
+	if !ok {
+		t.Fatal("unknown field was not reported", err)
+	}
+
+	if ex.Line != 5 {
+		t.Fatalf("unknown field reported on line %d", ex.Line)
+	}
+
+	_, err = ParseRouteTable(strings.NewReader(`{
+	"service": "io",
+	"routes": [
+		{"path": "behaviors"},
+		{"path": "session/exec",
+			"behaviors": ["exec"]}
+	]
+}`))
+
+	ex, ok = err.(*RouteTableError)
+
+	if !ok {
+		t.Fatal("unknown field was not reported", err)
+	}
+
+	if ex.Line != 6 {
+		t.Fatalf("unknown field matching an earlier value reported on line %d", ex.Line)
+	}
+
+	_, err = ParseRouteTable(strings.NewReader(`{
+	"service": "io",
+	"routes": [
+		{"path": "session/exec", "timeout": 20}
+	]
+}`))
+
+	ex, ok = err.(*RouteTableError)
+
+	if !ok {
+		t.Fatal("timeout without a fail behaviour was not reported", err)
+	}
+
+	if ex.Line != 4 {
+		t.Fatalf("timeout without a fail behaviour reported on line %d", ex.Line)
+	}
+}
+
+func TestRouteTableRouteFail(t *testing.T) {
+	table, err := ParseRouteTable(strings.NewReader(`{
+	"service": "io",
+	"routes": [
+		{"path": "session/shell", "timeout": 50, "fail": "discard"}
+	]
+}`))
+
+	if err != nil {
+		t.Fatal("unable to parse route table", err)
+	}
+
+	rc := table.Config()
+	r := NewRoute(table.Service, rc.buffer, rc.timeout, rc.fail)
+
+	if err := table.Build(r); err != nil {
+		t.Fatal("unable to build route table", err)
+	}
+
+	expired := make(chan interface{}, 1)
+
+	r.Child("session/shell").Expired.Subscribe(func(v interface{}, _ *flux.Sub) {
+		expired <- v
+	})
+
+	r.Serve("io/session/shell", "payload", 0)
+
+	select {
+	case <-expired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request on route with its own fail did not expire")
+	}
+}
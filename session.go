@@ -0,0 +1,605 @@
+package servicedrop
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/influx6/flux"
+)
+
+type (
+	//SessionManagerInterface represent the member function rules for a session manager
+	SessionManagerInterface interface {
+		AddSession(net.Addr, Session)
+		DestroySession(net.Addr)
+		GetSession(net.Addr) (Session, error)
+		SessionByUUID(string) (Session, error)
+		SessionsByUser(string) []Session
+		SessionsByType(string) []Session
+		Each(func(Session))
+		Touch(net.Addr)
+	}
+
+	//SessionManager is used to managed session data for any service using the
+	//net.Addr as a key and indexed by their user and uuid, sessions can be expired
+	//once idle or after a total lifetime with SetTTL and each expired session is
+	//emitted into Expired, the records of added and closed sessions are kept in
+	//the SessionStore set with UseStore up to the total set with KeepRecords,
+	//Claim and Release count the resources
+	//used by keys such as a user or address to enforce limits on them and the
+	//lifecycle of sessions is emitted as SessionEvents into Events
+	SessionManager struct {
+		Expired  *flux.Push
+		Events   *flux.Push
+		sessions map[string]*sessionEntry
+		users    map[string]map[string]bool
+		uuids    map[string]string
+		idle     time.Duration
+		absolute time.Duration
+		reaper   chan struct{}
+		store    SessionStore
+		records  []*SessionRecord
+		recorded map[string]int
+		keep     int
+		trimmed  int
+		claims   map[string]int
+		lock     *sync.RWMutex
+		saving   *sync.Mutex
+	}
+
+	//Session is a map that can contain the data needed for use
+	Session interface {
+		UseType(string)
+		Type() string
+		UUID() string
+		Addr() string
+		User() string
+		Pass() []byte
+		Start() time.Time
+		End() time.Time
+		Incoming() flux.StreamInterface
+		Outgoing() flux.StreamInterface
+		Close()
+	}
+
+	//BasicSession is the default Session implementation
+	BasicSession struct {
+		typ   string
+		uuid  string
+		addr  string
+		user  string
+		pass  []byte
+		start time.Time
+		end   time.Time
+		in    flux.StreamInterface
+		out   flux.StreamInterface
+		once  *sync.Once
+		lock  *sync.RWMutex
+	}
+
+	//sessionEntry is a session with the last time it was used
+	sessionEntry struct {
+		session Session
+		seen    time.Time
+	}
+)
+
+//DefaultKeepRecords is the total session records kept by new SessionManagers
+var DefaultKeepRecords = 1024
+
+//NewSessionManager allows management of sessions(ambiguous up to you to define that)
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		flux.PushSocket(0),
+		flux.PushSocket(0),
+		make(map[string]*sessionEntry),
+		make(map[string]map[string]bool),
+		make(map[string]string),
+		0,
+		0,
+		nil,
+		nil,
+		nil,
+		make(map[string]int),
+		DefaultKeepRecords,
+		0,
+		make(map[string]int),
+		new(sync.RWMutex),
+		new(sync.Mutex),
+	}
+}
+
+//GetSession retrieves a session with the net.Addr, this counts as a use of the
+//session for its idle time
+func (s *SessionManager) GetSession(addr net.Addr) (Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	se, ok := s.sessions[addr.String()]
+
+	if !ok {
+		return nil, ErrorNotFind
+	}
+
+	se.seen = time.Now()
+	return se.session, nil
+}
+
+//SessionByUUID retrieves a session by its uuid
+func (s *SessionManager) SessionByUUID(id string) (Session, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	se, ok := s.sessions[s.uuids[id]]
+
+	if !ok {
+		return nil, ErrorNotFind
+	}
+
+	return se.session, nil
+}
+
+//SessionsByUser returns the sessions of the user
+func (s *SessionManager) SessionsByUser(user string) []Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var list []Session
+
+	for key := range s.users[user] {
+		list = append(list, s.sessions[key].session)
+	}
+
+	return list
+}
+
+//SessionsByType returns the sessions currently using the type, as the type of
+//a session can change at any time this checks every session
+func (s *SessionManager) SessionsByType(t string) []Session {
+	var list []Session
+
+	s.Each(func(sm Session) {
+		if sm.Type() == t {
+			list = append(list, sm)
+		}
+	})
+
+	return list
+}
+
+//Each calls the function with every session within the manager, the function
+//receives a snapshot so it can add or destroy sessions
+func (s *SessionManager) Each(fx func(Session)) {
+	s.lock.RLock()
+
+	list := make([]Session, 0, len(s.sessions))
+
+	for _, se := range s.sessions {
+		list = append(list, se.session)
+	}
+
+	s.lock.RUnlock()
+
+	for _, sm := range list {
+		fx(sm)
+	}
+}
+
+//AddSession adds a new settion with the address, any session already using
+//the address is closed before the new one replaces it
+func (s *SessionManager) AddSession(addr net.Addr, sm Session) {
+	defer s.record(sm)
+	defer s.Events.Emit(newSessionEvent(SessionCreated, sm))
+
+	key := addr.String()
+
+	for {
+		s.lock.Lock()
+		se, ok := s.unindex(key)
+
+		if !ok {
+			break
+		}
+
+		s.lock.Unlock()
+		s.closeSession(se.session)
+	}
+
+	defer s.lock.Unlock()
+
+	s.sessions[key] = &sessionEntry{sm, time.Now()}
+
+	users, ok := s.users[sm.User()]
+
+	if !ok {
+		users = make(map[string]bool)
+		s.users[sm.User()] = users
+	}
+
+	users[key] = true
+	s.uuids[sm.UUID()] = key
+}
+
+//unindex removes the session with the key from the manager and its indexes,
+//the manager's lock must be held
+func (s *SessionManager) unindex(key string) (*sessionEntry, bool) {
+	se, ok := s.sessions[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	delete(s.sessions, key)
+
+	if users, ok := s.users[se.session.User()]; ok {
+		delete(users, key)
+
+		if len(users) <= 0 {
+			delete(s.users, se.session.User())
+		}
+	}
+
+	if s.uuids[se.session.UUID()] == key {
+		delete(s.uuids, se.session.UUID())
+	}
+
+	return se, true
+}
+
+//Touch marks the session with the address as used, resetting its idle time
+func (s *SessionManager) Touch(addr net.Addr) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if se, ok := s.sessions[addr.String()]; ok {
+		se.seen = time.Now()
+	}
+}
+
+//DestroySession deletes a session and its content from the map
+func (s *SessionManager) DestroySession(addr net.Addr) {
+	s.lock.Lock()
+	se, ok := s.unindex(addr.String())
+	s.lock.Unlock()
+
+	if ok {
+		s.closeSession(se.session)
+	}
+}
+
+//closeSession closes and records a session removed from the manager
+func (s *SessionManager) closeSession(sm Session) {
+	sm.Close()
+	s.record(sm)
+	s.Events.Emit(newSessionEvent(SessionClosed, sm))
+}
+
+//SetTTL sets the time a session can stay unused and the total time it can
+//live before it is closed and removed, a zero duration disables that limit and
+//when both are zero the background reaper is stopped
+func (s *SessionManager) SetTTL(idle, absolute time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.idle = idle
+	s.absolute = absolute
+
+	if s.reaper != nil {
+		close(s.reaper)
+		s.reaper = nil
+	}
+
+	every := idle
+
+	if every <= 0 || (absolute > 0 && absolute < every) {
+		every = absolute
+	}
+
+	if every <= 0 {
+		return
+	}
+
+	s.reaper = make(chan struct{})
+	go s.reap(every/2, s.reaper)
+}
+
+//Stop stops the background reaper of the manager
+func (s *SessionManager) Stop() {
+	s.SetTTL(0, 0)
+}
+
+//reap checks for expired sessions at every tick until stopped
+func (s *SessionManager) reap(every time.Duration, stop chan struct{}) {
+	if every <= 0 {
+		every = time.Millisecond
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.Expire(now)
+		}
+	}
+}
+
+//Expire closes and removes the sessions expired at the giving time and emits
+//each into the Expired socket, returning the total expired
+func (s *SessionManager) Expire(now time.Time) int {
+	var expired []Session
+
+	s.lock.Lock()
+
+	for key, se := range s.sessions {
+		idle := s.idle > 0 && now.Sub(se.seen) >= s.idle
+		dead := s.absolute > 0 && now.Sub(se.session.Start()) >= s.absolute
+
+		if idle || dead {
+			expired = append(expired, se.session)
+			s.unindex(key)
+		}
+	}
+
+	s.lock.Unlock()
+
+	for _, sm := range expired {
+		sm.Close()
+		s.record(sm)
+		s.Expired.Emit(sm)
+		s.Events.Emit(newSessionEvent(SessionExpired, sm))
+	}
+
+	return len(expired)
+}
+
+//Len returns the total sessions within the manager
+func (s *SessionManager) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.sessions)
+}
+
+//Claim takes one of the resources counted by the key, it returns false if the
+//key already holds max resources, a max of zero or less is unlimited
+func (s *SessionManager) Claim(key string, max int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if max > 0 && s.claims[key] >= max {
+		return false
+	}
+
+	s.claims[key]++
+	return true
+}
+
+//Release gives back a resource taken with Claim by the key
+func (s *SessionManager) Release(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.claims[key] <= 1 {
+		delete(s.claims, key)
+		return
+	}
+
+	s.claims[key]--
+}
+
+//Claims returns the total resources currently held by the key
+func (s *SessionManager) Claims(key string) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.claims[key]
+}
+
+//UseStore sets the store used to keep the session records of the manager and
+//loads the records already within it
+func (s *SessionManager) UseStore(store SessionStore) error {
+	records, err := store.Load()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.store = store
+
+	for _, rc := range records {
+		s.addRecord(rc)
+	}
+
+	return err
+}
+
+//KeepRecords sets the total session records kept by the manager, the records
+//of the oldest closed sessions are dropped beyond it and a CompactStore is
+//rewritten each time as many records were dropped, zero keeps every record
+func (s *SessionManager) KeepRecords(max int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keep = max
+	s.trim()
+}
+
+//Records returns the records of the sessions loaded from the store and those
+//added since
+func (s *SessionManager) Records() []*SessionRecord {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]*SessionRecord(nil), s.records...)
+}
+
+//record updates and saves the record of the session, compacting the store
+//once enough records were dropped
+func (s *SessionManager) record(sm Session) {
+	rc := NewSessionRecord(sm)
+
+	var kept []*SessionRecord
+
+	s.lock.Lock()
+	s.addRecord(rc)
+	store := s.store
+
+	if s.keep > 0 && s.trimmed >= s.keep {
+		kept = append(kept, s.records...)
+		s.trimmed = 0
+	}
+
+	s.lock.Unlock()
+
+	if store == nil {
+		return
+	}
+
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	if err := store.Save(rc); err != nil {
+		log.Printf("Unable to save session record for (%s): %+v", rc.Addr, err)
+	}
+
+	compact, ok := store.(CompactStore)
+
+	if !ok || kept == nil {
+		return
+	}
+
+	if err := compact.Compact(kept); err != nil {
+		log.Printf("Unable to compact session records: %+v", err)
+	}
+}
+
+//addRecord adds or replaces the record by its uuid, the manager's lock must be held
+func (s *SessionManager) addRecord(rc *SessionRecord) {
+	if at, ok := s.recorded[rc.UUID]; ok {
+		s.records[at] = rc
+		return
+	}
+
+	s.recorded[rc.UUID] = len(s.records)
+	s.records = append(s.records, rc)
+	s.trim()
+}
+
+//trim drops the records of the oldest closed sessions beyond the total kept,
+//the manager's lock must be held
+func (s *SessionManager) trim() {
+	if s.keep <= 0 || len(s.records) <= s.keep {
+		return
+	}
+
+	drop := len(s.records) - s.keep
+	records := make([]*SessionRecord, 0, len(s.records))
+
+	for _, rc := range s.records {
+		if drop > 0 && !rc.End.IsZero() {
+			drop--
+			s.trimmed++
+			delete(s.recorded, rc.UUID)
+			continue
+		}
+
+		s.recorded[rc.UUID] = len(records)
+		records = append(records, rc)
+	}
+
+	s.records = records
+}
+
+//NewBasicSession returns a new session for the user and address with identity
+//streams for its incoming and outgoing data
+func NewBasicSession(typ, addr, user string, pass []byte) *BasicSession {
+	return &BasicSession{
+		typ,
+		uuid.New(),
+		addr,
+		user,
+		pass,
+		time.Now(),
+		time.Time{},
+		flux.NewIdentityStream(),
+		flux.NewIdentityStream(),
+		new(sync.Once),
+		new(sync.RWMutex),
+	}
+}
+
+//UseType sets the type of the session
+func (b *BasicSession) UseType(t string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.typ = t
+}
+
+//Type returns the type of the session
+func (b *BasicSession) Type() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.typ
+}
+
+//UUID returns the unique id of the session
+func (b *BasicSession) UUID() string {
+	return b.uuid
+}
+
+//Addr returns the address of the session
+func (b *BasicSession) Addr() string {
+	return b.addr
+}
+
+//User returns the user of the session
+func (b *BasicSession) User() string {
+	return b.user
+}
+
+//Pass returns the password of the session
+func (b *BasicSession) Pass() []byte {
+	return b.pass
+}
+
+//Start returns the time the session was created
+func (b *BasicSession) Start() time.Time {
+	return b.start
+}
+
+//End returns the time the session was closed or the zero time if still open
+func (b *BasicSession) End() time.Time {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.end
+}
+
+//Incoming returns the stream of data coming into the session
+func (b *BasicSession) Incoming() flux.StreamInterface {
+	return b.in
+}
+
+//Outgoing returns the stream of data going out of the session
+func (b *BasicSession) Outgoing() flux.StreamInterface {
+	return b.out
+}
+
+//Close ends the session and closes its streams
+func (b *BasicSession) Close() {
+	b.once.Do(func() {
+		b.lock.Lock()
+		b.end = time.Now()
+		b.lock.Unlock()
+
+		if b.in != nil {
+			b.in.Close()
+		}
+
+		if b.out != nil {
+			b.out.Close()
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package servicedrop
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+)
+
+func TestSessionManagerExpire(t *testing.T) {
+	sm := NewSessionManager()
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3000}
+	session := NewBasicSession("ssh", addr.String(), "alex", nil)
+
+	sm.AddSession(addr, session)
+	sm.SetTTL(0, time.Minute)
+	defer sm.Stop()
+
+	if _, err := sm.GetSession(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3000}); err != nil {
+		t.Fatal("session not found by an equal address", err)
+	}
+
+	if total := sm.Expire(time.Now()); total != 0 {
+		t.Fatalf("live session expired: %d", total)
+	}
+
+	if total := sm.Expire(time.Now().Add(2 * time.Minute)); total != 1 {
+		t.Fatalf("session past its ttl was not expired: %d", total)
+	}
+
+	if session.End().IsZero() {
+		t.Fatal("expired session was not closed")
+	}
+
+	if _, err := sm.GetSession(addr); err != ErrorNotFind {
+		t.Fatal("expired session still within manager", err)
+	}
+}
+
+func TestSessionManagerIdleReaper(t *testing.T) {
+	sm := NewSessionManager()
+	defer sm.Stop()
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3001}
+	sm.AddSession(addr, NewBasicSession("ssh", addr.String(), "alex", nil))
+	sm.SetTTL(20*time.Millisecond, 0)
+
+	deadline := time.Now().Add(time.Second)
+
+	for sm.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle session was not reaped")
+		}
+		<-time.After(5 * time.Millisecond)
+	}
+}
+
+func TestSessionManagerIndexes(t *testing.T) {
+	sm := NewSessionManager()
+
+	a1 := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}
+	a2 := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4001}
+
+	s1 := NewBasicSession("shell", a1.String(), "alex", nil)
+	s2 := NewBasicSession("exec", a2.String(), "alex", nil)
+
+	sm.AddSession(a1, s1)
+	sm.AddSession(a2, s2)
+
+	if list := sm.SessionsByUser("alex"); len(list) != 2 {
+		t.Fatalf("incorrect sessions for user: %+v", list)
+	}
+
+	if found, err := sm.SessionByUUID(s2.UUID()); err != nil || found != s2 {
+		t.Fatal("session not found by its uuid", err)
+	}
+
+	s2.UseType("shell")
+
+	if list := sm.SessionsByType("shell"); len(list) != 2 {
+		t.Fatalf("incorrect sessions for type: %+v", list)
+	}
+
+	sm.DestroySession(a1)
+
+	if list := sm.SessionsByUser("alex"); len(list) != 1 || list[0] != s2 {
+		t.Fatalf("destroyed session still indexed: %+v", list)
+	}
+
+	if _, err := sm.SessionByUUID(s1.UUID()); err != ErrorNotFind {
+		t.Fatal("destroyed session still found by its uuid", err)
+	}
+
+	var total int
+	sm.Each(func(Session) { total++ })
+
+	if total != 1 {
+		t.Fatalf("incorrect total sessions iterated: %d", total)
+	}
+}
+
+func TestSessionManagerReplace(t *testing.T) {
+	sm := NewSessionManager()
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	old, fresh := NewBasicSession("ssh", addr.String(), "alex", nil), NewBasicSession("ssh", addr.String(), "bob", nil)
+
+	sm.AddSession(addr, old)
+
+	events := make(chan *SessionEvent, 4)
+
+	sm.EventSub(func(ev *SessionEvent, _ *flux.Sub) {
+		events <- ev
+	})
+
+	sm.AddSession(addr, fresh)
+
+	if old.End().IsZero() {
+		t.Fatal("replaced session was not closed")
+	}
+
+	for _, kind := range []string{SessionClosed, SessionCreated} {
+		select {
+		case ev := <-events:
+			if ev.Type != kind {
+				t.Fatalf("expected %s event, got %s", kind, ev.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event was emitted", kind)
+		}
+	}
+
+	if list := sm.SessionsByUser("alex"); len(list) != 0 {
+		t.Fatalf("replaced session still indexed: %+v", list)
+	}
+
+	if found, err := sm.GetSession(addr); err != nil || found != fresh {
+		t.Fatal("new session was not indexed", err)
+	}
+}
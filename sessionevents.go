@@ -0,0 +1,248 @@
+package servicedrop
+
+import (
+	"encoding/hex"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/influx6/flux"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	//SessionCreated is the event type of sessions added into a SessionManager
+	SessionCreated = "created"
+	//SessionAuthenticated is the event type of connections which completed their handshake
+	SessionAuthenticated = "authenticated"
+	//SessionChannelOpened is the event type of channels accepted on a connection
+	SessionChannelOpened = "channel-opened"
+	//SessionRequest is the event type of requests received on a channel
+	SessionRequest = "request"
+	//SessionClosed is the event type of sessions removed from a SessionManager
+	SessionClosed = "closed"
+	//SessionDisconnected is the event type of connections which ended
+	SessionDisconnected = "disconnected"
+	//SessionExpired is the event type of sessions removed by the TTL reaper
+	SessionExpired = "expired"
+	//SessionTimedOut is the event type of connections disconnected for missing
+	//keepalives or being idle, the Reason describes which
+	SessionTimedOut = "timed-out"
+)
+
+//SessionEvent describes a change in the lifecycle of a session or connection,
+//the events of a ssh connection carry the UUID and Session of the session it
+//was given while In and Out are the bytes read from and written into the
+//connection's channels so far
+type SessionEvent struct {
+	Type    string
+	Time    time.Time
+	UUID    string
+	User    string
+	Addr    string
+	Channel string
+	Request string
+	Reason  string
+	In      int64
+	Out     int64
+	Session Session
+}
+
+//newSessionEvent returns an event of the type for a session
+func newSessionEvent(kind string, sm Session) *SessionEvent {
+	return &SessionEvent{
+		Type:    kind,
+		Time:    time.Now(),
+		UUID:    sm.UUID(),
+		User:    sm.User(),
+		Addr:    sm.Addr(),
+		Session: sm,
+	}
+}
+
+//newConnEvent returns an event of the type for a ssh connection
+func newConnEvent(kind string, conn ssh.ConnMetadata, meter *SessionMeter) *SessionEvent {
+	in, out := meter.Bytes()
+
+	ev := &SessionEvent{
+		Type: kind,
+		Time: time.Now(),
+		UUID: hex.EncodeToString(conn.SessionID()),
+		User: conn.User(),
+		Addr: conn.RemoteAddr().String(),
+		In:   in,
+		Out:  out,
+	}
+
+	if sm := meter.Session(); sm != nil {
+		ev.UUID = sm.UUID()
+		ev.Session = sm
+	}
+
+	return ev
+}
+
+//EventSub decorates the SessionManager.Events.Subscribe with a more event friendly closure caller
+func (s *SessionManager) EventSub(fnx func(*SessionEvent, *flux.Sub)) *flux.Sub {
+	return s.Events.Subscribe(func(v interface{}, fs *flux.Sub) {
+		ev, ok := v.(*SessionEvent)
+
+		if !ok {
+			return
+		}
+
+		fnx(ev, fs)
+	})
+}
+
+//SessionMeter counts the bytes flowing through the channels of a connection
+//and the time of their last traffic for the session of the connection along
+//with the reason the server ended the connection if it did
+type SessionMeter struct {
+	in      int64
+	out     int64
+	last    int64
+	session Session
+	reason  atomic.Value
+}
+
+//NewSessionMeter returns a new meter
+func NewSessionMeter() *SessionMeter {
+	return &SessionMeter{0, 0, time.Now().UnixNano(), nil, atomic.Value{}}
+}
+
+//endWith records the reason the server is ending the connection
+func (m *SessionMeter) endWith(reason string) {
+	if m != nil {
+		m.reason.Store(reason)
+	}
+}
+
+//Reason returns the reason the server ended the connection or an empty
+//string if it did not
+func (m *SessionMeter) Reason() string {
+	if m == nil {
+		return ""
+	}
+
+	reason, _ := m.reason.Load().(string)
+	return reason
+}
+
+//Session returns the session the meter counts for
+func (m *SessionMeter) Session() Session {
+	if m == nil {
+		return nil
+	}
+	return m.session
+}
+
+//add counts the bytes read and written as traffic
+func (m *SessionMeter) add(in, out int) {
+	atomic.AddInt64(&m.in, int64(in))
+	atomic.AddInt64(&m.out, int64(out))
+	atomic.StoreInt64(&m.last, time.Now().UnixNano())
+}
+
+//Idle returns the time since the last traffic through the channels
+func (m *SessionMeter) Idle() time.Duration {
+	if m == nil {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&m.last)))
+}
+
+//Bytes returns the bytes read and written so far
+func (m *SessionMeter) Bytes() (int64, int64) {
+	if m == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&m.in), atomic.LoadInt64(&m.out)
+}
+
+//Channel returns the channel counting its bytes into the meter
+func (m *SessionMeter) Channel(ch ssh.Channel) ssh.Channel {
+	if m == nil {
+		return ch
+	}
+	return &meteredChannel{ch, m}
+}
+
+//meteredChannel is a ssh.Channel counting its bytes into a meter
+type meteredChannel struct {
+	ssh.Channel
+	meter *SessionMeter
+}
+
+//Read reads from the channel
+func (c *meteredChannel) Read(b []byte) (int, error) {
+	n, err := c.Channel.Read(b)
+	c.meter.add(n, 0)
+	return n, err
+}
+
+//Write writes into the channel
+func (c *meteredChannel) Write(b []byte) (int, error) {
+	n, err := c.Channel.Write(b)
+	c.meter.add(0, n)
+	return n, err
+}
+
+//Stderr returns the extended data stream of the channel
+func (c *meteredChannel) Stderr() io.ReadWriter {
+	return &meteredStream{c.Channel.Stderr(), c.meter}
+}
+
+//meteredStream is a io.ReadWriter counting its bytes into a meter
+type meteredStream struct {
+	io.ReadWriter
+	meter *SessionMeter
+}
+
+//Read reads from the stream
+func (c *meteredStream) Read(b []byte) (int, error) {
+	n, err := c.ReadWriter.Read(b)
+	c.meter.add(n, 0)
+	return n, err
+}
+
+//Write writes into the stream
+func (c *meteredStream) Write(b []byte) (int, error) {
+	n, err := c.ReadWriter.Write(b)
+	c.meter.add(0, n)
+	return n, err
+}
+
+//emitConn emits an event of the type for the connection into the session events
+func (s *SSHProtocol) emitConn(kind string, conn ssh.ConnMetadata, meter *SessionMeter, channel, request string) {
+	ev := newConnEvent(kind, conn, meter)
+	ev.Channel = channel
+	ev.Request = request
+	s.sessions.Events.Emit(ev)
+}
+
+//addSession adds the session of the connection into the session manager
+//unless a session was already added for its address while authenticating
+func (s *SSHProtocol) addSession(conn *ssh.ServerConn) Session {
+	if sm, err := s.sessions.GetSession(conn.RemoteAddr()); err == nil {
+		return sm
+	}
+
+	sm := NewBasicSession("ssh", conn.RemoteAddr().String(), conn.User(), nil)
+	s.sessions.AddSession(conn.RemoteAddr(), sm)
+	return sm
+}
+
+//watchConn emits the authenticated event of the connection and its
+//disconnected event with the total bytes and the reason the server ended it
+//once it ends, destroying the connection's session
+func (s *SSHProtocol) watchConn(conn *ssh.ServerConn, meter *SessionMeter) {
+	s.emitConn(SessionAuthenticated, conn, meter, "", "")
+	conn.Wait()
+
+	ev := newConnEvent(SessionDisconnected, conn, meter)
+	ev.Reason = meter.Reason()
+	s.sessions.Events.Emit(ev)
+
+	s.sessions.DestroySession(conn.RemoteAddr())
+}
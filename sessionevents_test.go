@@ -0,0 +1,109 @@
+package servicedrop
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+)
+
+type bufferChannel struct {
+	*bytes.Buffer
+}
+
+func (bufferChannel) Close() error      { return nil }
+func (bufferChannel) CloseWrite() error { return nil }
+func (bufferChannel) SendRequest(string, bool, []byte) (bool, error) {
+	return true, nil
+}
+func (b bufferChannel) Stderr() io.ReadWriter { return b.Buffer }
+
+func TestSessionMeter(t *testing.T) {
+	meter := NewSessionMeter()
+	ch := meter.Channel(bufferChannel{new(bytes.Buffer)})
+
+	ch.Write([]byte("hello"))
+	ch.Stderr().Write([]byte("!"))
+	ch.Read(make([]byte, 3))
+
+	if in, out := meter.Bytes(); in != 3 || out != 6 {
+		t.Fatalf("meter counted incorrect bytes: in %d out %d", in, out)
+	}
+}
+
+func TestSessionManagerEvents(t *testing.T) {
+	sm := NewSessionManager()
+	wait := new(sync.WaitGroup)
+
+	var kinds []string
+
+	sm.EventSub(func(ev *SessionEvent, _ *flux.Sub) {
+		kinds = append(kinds, ev.Type)
+
+		if ev.User != "alex" || ev.Session == nil {
+			t.Fatal("event is missing its session", ev)
+		}
+
+		wait.Done()
+	})
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6000}
+
+	wait.Add(2)
+	sm.AddSession(addr, NewBasicSession("shell", addr.String(), "alex", nil))
+	sm.DestroySession(addr)
+	wait.Wait()
+
+	if len(kinds) != 2 || kinds[0] != SessionCreated || kinds[1] != SessionClosed {
+		t.Fatalf("incorrect session events: %+v", kinds)
+	}
+}
+
+func TestSSHConnEvents(t *testing.T) {
+	serv, port := startExecProtocol(t)
+	defer serv.Drop()
+
+	events := make(chan *SessionEvent, 16)
+
+	serv.sessions.EventSub(func(ev *SessionEvent, _ *flux.Sub) {
+		events <- ev
+	})
+
+	dialSSHProtocol(t, port).Close()
+
+	var kinds []string
+	var id string
+
+	for len(kinds) == 0 || kinds[len(kinds)-1] != SessionClosed {
+		select {
+		case ev := <-events:
+			if id == "" {
+				id = ev.UUID
+			}
+
+			if ev.UUID != id {
+				t.Fatalf("%s event has uuid %s instead of %s", ev.Type, ev.UUID, id)
+			}
+
+			kinds = append(kinds, ev.Type)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("connection events did not end with the session closing: %+v", kinds)
+		}
+	}
+
+	expect := []string{SessionCreated, SessionAuthenticated, SessionDisconnected, SessionClosed}
+
+	if len(kinds) != len(expect) {
+		t.Fatalf("incorrect connection events: %+v", kinds)
+	}
+
+	for i, kind := range expect {
+		if kinds[i] != kind {
+			t.Fatalf("incorrect connection events: %+v", kinds)
+		}
+	}
+}
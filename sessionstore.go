@@ -0,0 +1,182 @@
+package servicedrop
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+//SessionRecord is the metadata of a session kept by a SessionStore, the
+//streams of a session are never stored
+type SessionRecord struct {
+	UUID  string    `json:"uuid"`
+	Type  string    `json:"type"`
+	User  string    `json:"user"`
+	Addr  string    `json:"addr"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+//SessionStore provides the storage backend used by a SessionManager to keep
+//the records of its sessions across restarts
+type SessionStore interface {
+	Save(*SessionRecord) error
+	Load() ([]*SessionRecord, error)
+	Close() error
+}
+
+//CompactStore is a SessionStore which can rewrite its storage to hold only
+//the records still kept by the SessionManager
+type CompactStore interface {
+	SessionStore
+	Compact([]*SessionRecord) error
+}
+
+//FileSessionStore stores session records as json lines appended into a file,
+//a session is saved when added and again once closed so the last line of a
+//session's uuid is its current record, Compact rewrites the file without the
+//older lines
+type FileSessionStore struct {
+	file string
+	fs   *os.File
+	lock *sync.Mutex
+}
+
+//NewSessionRecord returns the record of the session
+func NewSessionRecord(sm Session) *SessionRecord {
+	return &SessionRecord{
+		sm.UUID(),
+		sm.Type(),
+		sm.User(),
+		sm.Addr(),
+		sm.Start(),
+		sm.End(),
+	}
+}
+
+//NewFileSessionStore returns a store appending into the file, creating it if
+//it does not exist
+func NewFileSessionStore(file string) (*FileSessionStore, error) {
+	fs, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSessionStore{file, fs, new(sync.Mutex)}, nil
+}
+
+//Save appends the record into the file
+func (f *FileSessionStore) Save(rc *SessionRecord) error {
+	data, err := json.Marshal(rc)
+
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, err = f.fs.Write(append(data, '\n'))
+	return err
+}
+
+//Load reads the records within the file, returning the last record of each
+//session in the order they were first saved
+func (f *FileSessionStore) Load() ([]*SessionRecord, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fs, err := os.Open(f.file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fs.Close()
+
+	var records []*SessionRecord
+	index := make(map[string]int)
+
+	scan := bufio.NewScanner(fs)
+
+	for scan.Scan() {
+		if len(scan.Bytes()) <= 0 {
+			continue
+		}
+
+		rc := new(SessionRecord)
+
+		if err := json.Unmarshal(scan.Bytes(), rc); err != nil {
+			return records, err
+		}
+
+		if at, ok := index[rc.UUID]; ok {
+			records[at] = rc
+			continue
+		}
+
+		index[rc.UUID] = len(records)
+		records = append(records, rc)
+	}
+
+	return records, scan.Err()
+}
+
+//Compact rewrites the file with only the records, the new file replaces the
+//old one once fully written
+func (f *FileSessionStore) Compact(records []*SessionRecord) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	tmp := f.file + ".tmp"
+	fs, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fs)
+
+	for _, rc := range records {
+		data, err := json.Marshal(rc)
+
+		if err != nil {
+			fs.Close()
+			os.Remove(tmp)
+			return err
+		}
+
+		w.Write(append(data, '\n'))
+	}
+
+	if err := w.Flush(); err != nil {
+		fs.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := fs.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, f.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	f.fs.Close()
+
+	f.fs, err = os.OpenFile(f.file, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+//Close closes the file of the store
+func (f *FileSessionStore) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.fs.Close()
+}
@@ -0,0 +1,191 @@
+package servicedrop
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "sessions.log")
+	store, err := NewFileSessionStore(file)
+
+	if err != nil {
+		t.Fatal("unable to create store", err)
+	}
+
+	sm := NewSessionManager()
+
+	if err := sm.UseStore(store); err != nil {
+		t.Fatal("unable to load empty store", err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	session := NewBasicSession("shell", addr.String(), "alex", []byte("secret"))
+
+	sm.AddSession(addr, session)
+	sm.DestroySession(addr)
+	store.Close()
+
+	reloaded, err := NewFileSessionStore(file)
+
+	if err != nil {
+		t.Fatal("unable to reopen store", err)
+	}
+
+	defer reloaded.Close()
+
+	restarted := NewSessionManager()
+
+	if err := restarted.UseStore(reloaded); err != nil {
+		t.Fatal("unable to load store", err)
+	}
+
+	records := restarted.Records()
+
+	if len(records) != 1 {
+		t.Fatalf("incorrect total records: %+v", records)
+	}
+
+	rc := records[0]
+
+	if rc.UUID != session.UUID() || rc.User != "alex" || rc.Addr != addr.String() || rc.Type != "shell" {
+		t.Fatalf("incorrect record loaded: %+v", rc)
+	}
+
+	if rc.End.IsZero() || !rc.End.Equal(session.End()) {
+		t.Fatalf("record is missing the session end: %+v", rc)
+	}
+}
+
+func TestFileSessionStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "sessions.log")
+	store, err := NewFileSessionStore(file)
+
+	if err != nil {
+		t.Fatal("unable to create store", err)
+	}
+
+	defer store.Close()
+
+	sm := NewSessionManager()
+	sm.KeepRecords(2)
+
+	if err := sm.UseStore(store); err != nil {
+		t.Fatal("unable to load empty store", err)
+	}
+
+	var last Session
+
+	for i := 0; i < 6; i++ {
+		addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000 + i}
+		last = NewBasicSession("shell", addr.String(), "alex", nil)
+		sm.AddSession(addr, last)
+		sm.DestroySession(addr)
+	}
+
+	records := sm.Records()
+
+	if len(records) != 2 || records[1].UUID != last.UUID() {
+		t.Fatalf("manager kept incorrect records: %+v", records)
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(data), "\n"); lines >= 12 {
+		t.Fatalf("store was not compacted, it has %d lines", lines)
+	}
+
+	loaded, err := store.Load()
+
+	if err != nil {
+		t.Fatal("unable to load compacted store", err)
+	}
+
+	if len(loaded) > 4 || loaded[len(loaded)-1].UUID != last.UUID() {
+		t.Fatalf("compacted store has incorrect records: %+v", loaded)
+	}
+}
+
+func TestSSHSessionRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "sessions.log")
+	store, err := NewFileSessionStore(file)
+
+	if err != nil {
+		t.Fatal("unable to create store", err)
+	}
+
+	defer store.Close()
+
+	serv, port := startExecProtocol(t)
+	defer serv.Drop()
+
+	if err := serv.sessions.UseStore(store); err != nil {
+		t.Fatal("unable to load empty store", err)
+	}
+
+	client := dialSSHProtocol(t, port)
+	deadline := time.Now().Add(2 * time.Second)
+
+	for serv.sessions.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection has no session")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	if sessions := serv.sessions.SessionsByUser("alex"); len(sessions) != 1 || sessions[0].Type() != "ssh" {
+		t.Fatalf("connection has an incorrect session: %+v", sessions)
+	}
+
+	client.Close()
+
+	for serv.sessions.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session of the closed connection was not destroyed")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	loaded, err := store.Load()
+
+	if err != nil {
+		t.Fatal("unable to load store", err)
+	}
+
+	if len(loaded) != 1 || loaded[0].User != "alex" || loaded[0].End.IsZero() {
+		t.Fatalf("connection was not persisted: %+v", loaded)
+	}
+}
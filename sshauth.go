@@ -0,0 +1,360 @@
+package servicedrop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	//SSHAuthKey is the name of the public key authentication method
+	SSHAuthKey = "publickey"
+	//SSHAuthPassword is the name of the password authentication method
+	SSHAuthPassword = "password"
+	//SSHAuthInteractive is the name of the keyboard-interactive authentication method
+	SSHAuthInteractive = "keyboard-interactive"
+)
+
+//ErrAuthLockout is returned for authentication attempts from locked out addresses
+var ErrAuthLockout = errors.New("too many failed authentication attempts")
+
+//DefaultAuthLockout is how long addresses are locked out when MaxAttempts is
+//set without a Lockout duration
+var DefaultAuthLockout = 15 * time.Minute
+
+//SSHAuth configures the authentication methods of NewSSHProtocol, clients can
+//use any of the set callbacks unless Steps lists the methods they must all
+//pass in that order, addresses failing MaxAttempts password or interactive
+//attempts in a row are locked out for the Lockout duration or the
+//DefaultAuthLockout if it is zero, refused keys are not counted as agents
+//offer several keys and failures older than the lockout duration are
+//forgotten, a zero MaxAttempts disables the lockout
+type SSHAuth struct {
+	Key         KeyAuthenticationCallback
+	Password    PasswordAuthenticationCallback
+	Interactive InteractiveAuthenticationCallback
+	Steps       []string
+	MaxAttempts int
+	Lockout     time.Duration
+}
+
+//NewSSHProtocol creates a ssh-server that handles ssh-connections authenticated
+//with the combination of methods of the auth
+func NewSSHProtocol(rc *RouteConfig, service, addr string, port int, rsaFile string, auth *SSHAuth) *SSHProtocol {
+	conf := &ssh.ServerConfig{}
+	sd := newSSHProtocol(rc, service, addr, port, rsaFile, conf)
+
+	chain, err := newAuthChain(auth, sd)
+
+	if err != nil {
+		panic(fmt.Sprintf("AuthError: Invalid ssh authentication: %v", err))
+	}
+
+	chain.allow = sd.allowUser
+	sd.auth = chain
+
+	first := chain.stage(0, nil)
+	conf.PublicKeyCallback = first.PublicKeyCallback
+	conf.PasswordCallback = first.PasswordCallback
+	conf.KeyboardInteractiveCallback = first.KeyboardInteractiveCallback
+
+	return sd
+}
+
+//authChain builds the authentication callbacks of each stage of a SSHAuth
+type authChain struct {
+	key         KeyAuth
+	password    PassAuth
+	interactive InteractiveAuth
+	stages      [][]string
+	lockout     *authLockout
+	allow       func(user string) bool
+}
+
+//newAuthChain returns the stages of the auth for the protocol, all methods
+//form a single stage unless the auth has steps
+func newAuthChain(auth *SSHAuth, p ProtocolInterface) (*authChain, error) {
+	chain := &authChain{lockout: newAuthLockout(auth.MaxAttempts, auth.Lockout)}
+
+	var methods []string
+
+	if auth.Key != nil {
+		chain.key = KeyAuthenticationWrap(auth.Key, p)
+		methods = append(methods, SSHAuthKey)
+	}
+
+	if auth.Password != nil {
+		chain.password = PasswordAuthenticationWrap(auth.Password, p)
+		methods = append(methods, SSHAuthPassword)
+	}
+
+	if auth.Interactive != nil {
+		chain.interactive = InteractiveAuthenticationWrap(auth.Interactive, p)
+		methods = append(methods, SSHAuthInteractive)
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no authentication callbacks")
+	}
+
+	if len(auth.Steps) == 0 {
+		chain.stages = [][]string{methods}
+		return chain, nil
+	}
+
+	for _, step := range auth.Steps {
+		if !chain.has(step) {
+			return nil, fmt.Errorf("no callback for authentication step '%s'", step)
+		}
+
+		chain.stages = append(chain.stages, []string{step})
+	}
+
+	return chain, nil
+}
+
+//has returns true if the chain has the callback of the method
+func (a *authChain) has(method string) bool {
+	switch method {
+	case SSHAuthKey:
+		return a.key != nil
+	case SSHAuthPassword:
+		return a.password != nil
+	case SSHAuthInteractive:
+		return a.interactive != nil
+	}
+
+	return false
+}
+
+//refuse returns the error refusing the attempt of locked out addresses and of
+//users holding their maximum connections
+func (a *authChain) refuse(meta ssh.ConnMetadata) error {
+	if a.lockout.locked(remoteIP(meta.RemoteAddr())) {
+		return ErrAuthLockout
+	}
+
+	if a.allow != nil && !a.allow(meta.User()) {
+		return errUserConnections
+	}
+
+	return nil
+}
+
+//stage returns the callbacks of the stage, the permissions granted by the
+//previous stages are merged into those of the final stage, only refused
+//passwords and interactive attempts count towards the lockout and as public
+//keys are checked before their signature is verified the failed attempts are
+//only cleared once the connection is established
+func (a *authChain) stage(n int, granted *ssh.Permissions) ssh.ServerAuthCallbacks {
+	done := func(meta ssh.ConnMetadata, perms *ssh.Permissions, err error) (*ssh.Permissions, error) {
+		if err != nil {
+			return nil, err
+		}
+
+		perms = mergePermissions(granted, perms)
+
+		if n < len(a.stages)-1 {
+			return nil, &ssh.PartialSuccessError{Next: a.stage(n+1, perms)}
+		}
+
+		return perms, nil
+	}
+
+	var cbs ssh.ServerAuthCallbacks
+
+	for _, method := range a.stages[n] {
+		switch method {
+		case SSHAuthKey:
+			cbs.PublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if err := a.refuse(meta); err != nil {
+					return nil, err
+				}
+
+				perms, err := a.key(meta, key)
+				return done(meta, perms, err)
+			}
+		case SSHAuthPassword:
+			cbs.PasswordCallback = func(meta ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+				if err := a.refuse(meta); err != nil {
+					return nil, err
+				}
+
+				perms, err := a.password(meta, pass)
+
+				if err != nil {
+					a.lockout.fail(remoteIP(meta.RemoteAddr()))
+				}
+
+				return done(meta, perms, err)
+			}
+		case SSHAuthInteractive:
+			cbs.KeyboardInteractiveCallback = func(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				if err := a.refuse(meta); err != nil {
+					return nil, err
+				}
+
+				perms, err := a.interactive(meta, client)
+
+				if err != nil {
+					a.lockout.fail(remoteIP(meta.RemoteAddr()))
+				}
+
+				return done(meta, perms, err)
+			}
+		}
+	}
+
+	return cbs
+}
+
+//mergePermissions returns the permissions granted by both, critical options are
+//combined while only the extensions allowed by both remain
+func mergePermissions(a, b *ssh.Permissions) *ssh.Permissions {
+	if a == nil {
+		return b
+	}
+
+	if b == nil {
+		return a
+	}
+
+	perms := &ssh.Permissions{CriticalOptions: make(map[string]string)}
+
+	for k, v := range a.CriticalOptions {
+		perms.CriticalOptions[k] = v
+	}
+
+	for k, v := range b.CriticalOptions {
+		perms.CriticalOptions[k] = v
+	}
+
+	switch {
+	case a.Extensions == nil:
+		perms.Extensions = b.Extensions
+	case b.Extensions == nil:
+		perms.Extensions = a.Extensions
+	default:
+		perms.Extensions = make(map[string]string)
+
+		for k, v := range b.Extensions {
+			if _, ok := a.Extensions[k]; ok {
+				perms.Extensions[k] = v
+			}
+		}
+	}
+
+	return perms
+}
+
+//authFailures holds the failed attempts of an address and when it last failed
+type authFailures struct {
+	count int
+	last  time.Time
+}
+
+//authLockout counts the failed authentication attempts of each address in a
+//row, locking the address out once it reaches the maximum attempts
+type authLockout struct {
+	max      int
+	duration time.Duration
+	failures map[string]authFailures
+	until    map[string]time.Time
+	swept    time.Time
+	lock     *sync.Mutex
+}
+
+//newAuthLockout returns a lockout after max failed attempts for the duration,
+//the DefaultAuthLockout is used if the duration is not set
+func newAuthLockout(max int, duration time.Duration) *authLockout {
+	if duration <= 0 {
+		duration = DefaultAuthLockout
+	}
+
+	return &authLockout{
+		max,
+		duration,
+		make(map[string]authFailures),
+		make(map[string]time.Time),
+		time.Now(),
+		new(sync.Mutex),
+	}
+}
+
+//locked returns true if the address is locked out
+func (l *authLockout) locked(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	until, ok := l.until[ip]
+
+	if !ok {
+		return false
+	}
+
+	if time.Now().Before(until) {
+		return true
+	}
+
+	delete(l.until, ip)
+	return false
+}
+
+//fail counts a failed attempt of the address
+func (l *authLockout) fail(ip string) {
+	if l.max <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	failed := l.failures[ip]
+	failed.count++
+	failed.last = now
+
+	if failed.count < l.max {
+		l.failures[ip] = failed
+		return
+	}
+
+	log.Printf("Locking out (%s) after %d failed authentication attempts", ip, failed.count)
+	delete(l.failures, ip)
+	l.until[ip] = now.Add(l.duration)
+}
+
+//sweep drops the expired lockouts and the failures older than the lockout
+//duration at most once per duration, the lock must be held
+func (l *authLockout) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.duration {
+		return
+	}
+
+	l.swept = now
+
+	for ip, until := range l.until {
+		if !now.Before(until) {
+			delete(l.until, ip)
+		}
+	}
+
+	for ip, failed := range l.failures {
+		if now.Sub(failed.last) >= l.duration {
+			delete(l.failures, ip)
+		}
+	}
+}
+
+//reset clears the failed attempts of the address once it authenticates
+func (l *authLockout) reset(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.failures, ip)
+}
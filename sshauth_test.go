@@ -0,0 +1,285 @@
+package servicedrop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+	"golang.org/x/crypto/ssh"
+)
+
+func startAuthProtocol(t *testing.T, auth *SSHAuth) (*SSHProtocol, int) {
+	conf := NewRouteConfig(0, -1, func(act flux.ActionInterface) {})
+	port := freePort(t)
+
+	serv := NewSSHProtocol(conf, "io", "127.0.0.1", port, "./perm/perm", auth)
+
+	go serv.Dial()
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		con, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+
+		if err == nil {
+			con.Close()
+			return serv, port
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("ssh-server did not start", err)
+		}
+
+		<-time.After(20 * time.Millisecond)
+	}
+}
+
+func dialAuth(port int, auth ...ssh.AuthMethod) error {
+	client, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &ssh.ClientConfig{
+		User: "alex",
+		Auth: auth,
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			return nil
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return client.Close()
+}
+
+func passwordCallback(secret string) PasswordAuthenticationCallback {
+	return func(_ ProtocolInterface, _ ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		if string(pass) != secret {
+			return nil, errors.New("incorrect password")
+		}
+		return nil, nil
+	}
+}
+
+func TestSSHAuthSteps(t *testing.T) {
+	signer := newTestSigner(t)
+
+	serv, port := startAuthProtocol(t, &SSHAuth{
+		Key: func(_ ProtocolInterface, _ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+				return nil, ErrUnauthorizedKey
+			}
+			return nil, nil
+		},
+		Password: passwordCallback("secret"),
+		Steps:    []string{SSHAuthKey, SSHAuthPassword},
+	})
+	defer serv.Drop()
+
+	if err := dialAuth(port, ssh.Password("secret")); err == nil {
+		t.Fatal("expected password alone to be refused")
+	}
+
+	if err := dialAuth(port, ssh.PublicKeys(signer)); err == nil {
+		t.Fatal("expected key alone to be refused")
+	}
+
+	if err := dialAuth(port, ssh.PublicKeys(signer), ssh.Password("secret")); err != nil {
+		t.Fatal("expected key and password to be authorized", err)
+	}
+}
+
+func TestSSHAuthInteractive(t *testing.T) {
+	serv, port := startAuthProtocol(t, &SSHAuth{
+		Interactive: func(_ ProtocolInterface, _ ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "", []string{"code: "}, []bool{false})
+
+			if err != nil {
+				return nil, err
+			}
+
+			if len(answers) != 1 || answers[0] != "1234" {
+				return nil, errors.New("incorrect code")
+			}
+
+			return nil, nil
+		},
+	})
+	defer serv.Drop()
+
+	answer := func(code string) ssh.AuthMethod {
+		return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{code}, nil
+		})
+	}
+
+	if err := dialAuth(port, answer("0000")); err == nil {
+		t.Fatal("expected incorrect code to be refused")
+	}
+
+	if err := dialAuth(port, answer("1234")); err != nil {
+		t.Fatal("expected correct code to be authorized", err)
+	}
+}
+
+func TestSSHAuthLockout(t *testing.T) {
+	serv, port := startAuthProtocol(t, &SSHAuth{
+		Password:    passwordCallback("secret"),
+		MaxAttempts: 2,
+		Lockout:     time.Minute,
+	})
+	defer serv.Drop()
+
+	if err := dialAuth(port, ssh.Password("secret")); err != nil {
+		t.Fatal("expected password to be authorized", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := dialAuth(port, ssh.Password("wrong")); err == nil {
+			t.Fatal("expected incorrect password to be refused")
+		}
+	}
+
+	if err := dialAuth(port, ssh.Password("secret")); err == nil {
+		t.Fatal("expected locked out address to be refused")
+	}
+}
+
+func TestSSHAuthKeyResetsLockout(t *testing.T) {
+	signer := newTestSigner(t)
+
+	serv, port := startAuthProtocol(t, &SSHAuth{
+		Key: func(_ ProtocolInterface, _ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+				return nil, ErrUnauthorizedKey
+			}
+			return nil, nil
+		},
+		Password:    passwordCallback("secret"),
+		MaxAttempts: 3,
+		Lockout:     time.Minute,
+	})
+	defer serv.Drop()
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 2; i++ {
+			if err := dialAuth(port, ssh.Password("wrong")); err == nil {
+				t.Fatal("expected incorrect password to be refused")
+			}
+		}
+
+		if err := dialAuth(port, ssh.PublicKeys(signer)); err != nil {
+			t.Fatal("expected key to be authorized", err)
+		}
+	}
+}
+
+func TestSSHAuthKeysNotCounted(t *testing.T) {
+	signer, other, another := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+
+	serv, port := startAuthProtocol(t, &SSHAuth{
+		Key: func(_ ProtocolInterface, _ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+				return nil, ErrUnauthorizedKey
+			}
+			return nil, nil
+		},
+		Password:    passwordCallback("secret"),
+		MaxAttempts: 1,
+		Lockout:     time.Minute,
+	})
+	defer serv.Drop()
+
+	//an agent offering several keys is not locked out by the refused ones
+	if err := dialAuth(port, ssh.PublicKeys(other, another, signer)); err != nil {
+		t.Fatal("expected the last offered key to be authorized", err)
+	}
+
+	if err := dialAuth(port, ssh.PublicKeys(other, another)); err == nil {
+		t.Fatal("expected unknown keys to be refused")
+	}
+
+	if err := dialAuth(port, ssh.Password("secret")); err != nil {
+		t.Fatal("expected refused keys not to lock the address out", err)
+	}
+}
+
+func TestSSHAuthStageLimits(t *testing.T) {
+	conf := NewRouteConfig(0, -1, func(act flux.ActionInterface) {})
+
+	serv := NewSSHProtocol(conf, "io", "127.0.0.1", freePort(t), "./perm/perm", &SSHAuth{
+		Key: func(_ ProtocolInterface, _ ssh.ConnMetadata, _ ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+		Password: passwordCallback("secret"),
+		Steps:    []string{SSHAuthKey, SSHAuthPassword},
+	})
+
+	serv.UseLimits(&SSHLimits{UserConnections: 1})
+
+	meta := &testConnMeta{"alex", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2000}}
+	second := serv.auth.stage(1, nil)
+
+	if _, err := second.PasswordCallback(meta, []byte("secret")); err != nil {
+		t.Fatal("expected password to be authorized", err)
+	}
+
+	serv.sessions.Claim(limitKey("user-conn", "alex"), 1)
+
+	if _, err := second.PasswordCallback(meta, []byte("secret")); err != errUserConnections {
+		t.Fatal("expected later stage to be refused above the user limit", err)
+	}
+}
+
+func TestAuthLockoutSweep(t *testing.T) {
+	lockout := newAuthLockout(2, 20*time.Millisecond)
+
+	lockout.fail("10.0.0.1")
+	lockout.fail("10.0.0.2")
+	lockout.fail("10.0.0.2")
+
+	<-time.After(30 * time.Millisecond)
+
+	lockout.fail("10.0.0.3")
+
+	if len(lockout.failures) != 1 || len(lockout.until) != 0 {
+		t.Fatalf("stale entries were not expired: %+v %+v", lockout.failures, lockout.until)
+	}
+
+	if lockout.failures["10.0.0.3"].count != 1 {
+		t.Fatal("new failure was not counted", lockout.failures)
+	}
+}
+
+func TestAuthLockoutDefaultDuration(t *testing.T) {
+	lockout := newAuthLockout(1, 0)
+
+	if lockout.duration != DefaultAuthLockout {
+		t.Fatalf("expected the default lockout duration, got %s", lockout.duration)
+	}
+
+	lockout.fail("10.0.0.1")
+
+	if !lockout.locked("10.0.0.1") {
+		t.Fatal("expected the address to be locked out without a lockout duration")
+	}
+}
+
+func TestMergePermissions(t *testing.T) {
+	perms := mergePermissions(&ssh.Permissions{
+		CriticalOptions: map[string]string{ForceCommandOption: "uptime"},
+		Extensions:      map[string]string{PermitPty: "", PermitPortForwarding: ""},
+	}, &ssh.Permissions{
+		Extensions: map[string]string{PermitPortForwarding: ""},
+	})
+
+	if cmd, _ := ForcedCommand(perms); cmd != "uptime" {
+		t.Fatal("expected critical options to be combined", perms.CriticalOptions)
+	}
+
+	if Permitted(perms, PermitPty) || !Permitted(perms, PermitPortForwarding) {
+		t.Fatal("expected only extensions granted by both", perms.Extensions)
+	}
+}
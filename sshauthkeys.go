@@ -0,0 +1,351 @@
+package servicedrop
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	//PermitPty is the permission extension allowing pty requests
+	PermitPty = "permit-pty"
+	//PermitPortForwarding is the permission extension allowing port forwards
+	PermitPortForwarding = "permit-port-forwarding"
+	//PermitAgentForwarding is the permission extension allowing agent forwarding
+	PermitAgentForwarding = "permit-agent-forwarding"
+	//PermitX11Forwarding is the permission extension allowing x11 forwarding
+	PermitX11Forwarding = "permit-X11-forwarding"
+	//PermitUserRC is the permission extension allowing the user's rc file
+	PermitUserRC = "permit-user-rc"
+
+	//ForceCommandOption is the critical option of the command run instead of
+	//the shell, exec and subsystem requests of the connection
+	ForceCommandOption = "force-command"
+	//PermitOpenOption is the critical option of the comma separated
+	//'host:port' destinations local forwards are restricted to
+	PermitOpenOption = "permitopen"
+)
+
+//ErrUnauthorizedKey is returned for public keys not within the authorized keys
+var ErrUnauthorizedKey = errors.New("public key not authorized")
+
+//ErrSourceNotAllowed is returned for keys used from addresses not within their from= option
+var ErrSourceNotAllowed = errors.New("key not allowed from source address")
+
+//defaultPermits are the extensions of keys without restricting options
+var defaultPermits = []string{
+	PermitPty,
+	PermitPortForwarding,
+	PermitAgentForwarding,
+	PermitX11Forwarding,
+	PermitUserRC,
+}
+
+//Permitted returns true if the permissions allow the extension, connections
+//without permission extensions eg. password authenticated ones are unrestricted
+func Permitted(perms *ssh.Permissions, ext string) bool {
+	if perms == nil || perms.Extensions == nil {
+		return true
+	}
+
+	_, ok := perms.Extensions[ext]
+	return ok
+}
+
+//ForcedCommand returns the command the permissions force in place of the
+//connection's requested commands
+func ForcedCommand(perms *ssh.Permissions) (string, bool) {
+	if perms == nil {
+		return "", false
+	}
+
+	cmd, ok := perms.CriticalOptions[ForceCommandOption]
+	return cmd, ok
+}
+
+//PermitOpen returns true if the permissions allow local forwards to the host
+//and port, the destinations are only restricted by a permitopen option
+func PermitOpen(perms *ssh.Permissions, host string, port uint32) bool {
+	if !Permitted(perms, PermitPortForwarding) {
+		return false
+	}
+
+	if perms == nil {
+		return true
+	}
+
+	opens, ok := perms.CriticalOptions[PermitOpenOption]
+
+	if !ok {
+		return true
+	}
+
+	return matchDestination(strings.Split(opens, ","), host, port)
+}
+
+//authorizedKey is a key of an authorized_keys file with its options
+type authorizedKey struct {
+	key     []byte
+	from    []string
+	options map[string]string
+	permits map[string]string
+}
+
+//permissions returns the permissions granted to connections using the key
+func (a *authorizedKey) permissions() *ssh.Permissions {
+	perms := &ssh.Permissions{
+		CriticalOptions: make(map[string]string),
+		Extensions:      make(map[string]string),
+	}
+
+	for k, v := range a.options {
+		perms.CriticalOptions[k] = v
+	}
+
+	for k, v := range a.permits {
+		perms.Extensions[k] = v
+	}
+
+	return perms
+}
+
+//allowFrom returns true if the key can be used from the address
+func (a *authorizedKey) allowFrom(addr net.Addr) bool {
+	if len(a.from) == 0 {
+		return true
+	}
+
+	return matchSource(a.from, remoteIP(addr))
+}
+
+//matchSource matches the ip against the from= patterns, which are ip
+//wildcards or cidr blocks and are negated with a leading '!'
+func matchSource(patterns []string, ip string) bool {
+	var matched bool
+
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+
+		if _, block, err := net.ParseCIDR(pattern); err == nil {
+			ok = block.Contains(net.ParseIP(ip))
+		} else {
+			ok, _ = path.Match(pattern, ip)
+		}
+
+		if !ok {
+			continue
+		}
+
+		if negate {
+			return false
+		}
+
+		matched = true
+	}
+
+	return matched
+}
+
+//parseAuthorizedKeys parses the keys of an authorized_keys file, skipping the
+//lines which are not keys or use options which are not supported
+func parseAuthorizedKeys(data []byte) []*authorizedKey {
+	var keys []*authorizedKey
+
+	for len(data) > 0 {
+		pub, _, options, rest, err := ssh.ParseAuthorizedKey(data)
+
+		if err != nil {
+			break
+		}
+
+		data = rest
+
+		if key := newAuthorizedKey(pub, options); key != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+//newAuthorizedKey returns the key with the permissions of its options or nil
+//if it uses an unsupported option, such keys are not trusted at all rather
+//than trusted without the restriction of the option
+func newAuthorizedKey(pub ssh.PublicKey, options []string) *authorizedKey {
+	key := &authorizedKey{pub.Marshal(), nil, make(map[string]string), make(map[string]string)}
+
+	for _, ext := range defaultPermits {
+		key.permits[ext] = ""
+	}
+
+	var opens []string
+
+	for _, option := range options {
+		name, value := option, ""
+
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], unquoteOption(option[i+1:])
+		}
+
+		switch strings.ToLower(name) {
+		case "command":
+			key.options[ForceCommandOption] = value
+		case "from":
+			key.from = strings.Split(value, ",")
+		case "permitopen":
+			opens = append(opens, value)
+		case "no-pty":
+			delete(key.permits, PermitPty)
+		case "no-port-forwarding":
+			delete(key.permits, PermitPortForwarding)
+		case "no-agent-forwarding":
+			delete(key.permits, PermitAgentForwarding)
+		case "no-x11-forwarding":
+			delete(key.permits, PermitX11Forwarding)
+		case "no-user-rc":
+			delete(key.permits, PermitUserRC)
+		case "restrict":
+			key.permits = make(map[string]string)
+		case "pty":
+			key.permits[PermitPty] = ""
+		case "port-forwarding":
+			key.permits[PermitPortForwarding] = ""
+		case "agent-forwarding":
+			key.permits[PermitAgentForwarding] = ""
+		case "x11-forwarding":
+			key.permits[PermitX11Forwarding] = ""
+		case "user-rc":
+			key.permits[PermitUserRC] = ""
+		case "cert-authority", "expiry-time":
+			return nil
+		}
+	}
+
+	if len(opens) > 0 {
+		key.options[PermitOpenOption] = strings.Join(opens, ",")
+	}
+
+	return key
+}
+
+//unquoteOption removes the quotes and escapes of an option value
+func unquoteOption(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+
+	return strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+}
+
+//keysFile is a loaded authorized_keys file
+type keysFile struct {
+	mod  time.Time
+	size int64
+	keys []*authorizedKey
+}
+
+//AuthorizedKeys authenticates public keys against the OpenSSH authorized_keys
+//file of each user, files are reloaded once they change
+type AuthorizedKeys struct {
+	File  func(user string) (string, error)
+	files map[string]*keysFile
+	lock  *sync.Mutex
+}
+
+//NewAuthorizedKeys returns the authorized keys read from the file of each user
+func NewAuthorizedKeys(file func(string) (string, error)) *AuthorizedKeys {
+	return &AuthorizedKeys{file, make(map[string]*keysFile), new(sync.Mutex)}
+}
+
+//AuthorizedKeysFile returns the authorized keys of a single file shared by all users
+func AuthorizedKeysFile(file string) *AuthorizedKeys {
+	return NewAuthorizedKeys(func(string) (string, error) {
+		return file, nil
+	})
+}
+
+//AuthorizedKeysDir returns the authorized keys of each user read from the
+//file named after the user within the directory
+func AuthorizedKeysDir(dir string) *AuthorizedKeys {
+	return NewAuthorizedKeys(func(user string) (string, error) {
+		if user == "" || user != filepath.Base(user) || user == "." || user == ".." {
+			return "", ErrUnauthorizedKey
+		}
+
+		return filepath.Join(dir, user), nil
+	})
+}
+
+//Auth authenticates the key of the connection, it can be used as the KeyAuth
+//of RSASSHProtocol and returns the permissions of the key's options
+func (a *AuthorizedKeys) Auth(meta ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+	file, err := a.File(meta.User())
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := a.load(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	wire := pub.Marshal()
+
+	for _, key := range keys {
+		if !bytes.Equal(key.key, wire) {
+			continue
+		}
+
+		if !key.allowFrom(meta.RemoteAddr()) {
+			return nil, ErrSourceNotAllowed
+		}
+
+		return key.permissions(), nil
+	}
+
+	return nil, ErrUnauthorizedKey
+}
+
+//load returns the keys of the file, reading it again if it changed since it
+//was last read
+func (a *AuthorizedKeys) load(file string) ([]*authorizedKey, error) {
+	info, err := os.Stat(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	loaded, ok := a.files[file]
+
+	if ok && loaded.mod.Equal(info.ModTime()) && loaded.size == info.Size() {
+		return loaded.keys, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	loaded = &keysFile{info.ModTime(), info.Size(), parseAuthorizedKeys(data)}
+	a.files[file] = loaded
+
+	return loaded.keys, nil
+}
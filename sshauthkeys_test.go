@@ -0,0 +1,231 @@
+package servicedrop
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+	"golang.org/x/crypto/ssh"
+)
+
+type testConnMeta struct {
+	user string
+	addr net.Addr
+}
+
+func (t *testConnMeta) User() string          { return t.user }
+func (t *testConnMeta) SessionID() []byte     { return nil }
+func (t *testConnMeta) ClientVersion() []byte { return nil }
+func (t *testConnMeta) ServerVersion() []byte { return nil }
+func (t *testConnMeta) RemoteAddr() net.Addr  { return t.addr }
+func (t *testConnMeta) LocalAddr() net.Addr   { return t.addr }
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+func writeAuthorizedKeys(t *testing.T, file string, mod time.Time, lines ...string) {
+	var data []byte
+
+	for _, line := range lines {
+		data = append(data, line...)
+	}
+
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(file, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorizedKeysOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authkeys")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	forced, remote, restricted, later := newTestSigner(t), newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	file := filepath.Join(dir, "alex")
+	now := time.Now()
+
+	writeAuthorizedKeys(t, file, now,
+		`command="echo forced",no-pty,permitopen="127.0.0.1:80" `+string(ssh.MarshalAuthorizedKey(forced.PublicKey())),
+		`from="10.0.0.*,!10.0.0.1" `+string(ssh.MarshalAuthorizedKey(remote.PublicKey())),
+		`restrict,pty,port-forwarding `+string(ssh.MarshalAuthorizedKey(restricted.PublicKey())),
+	)
+
+	keys := AuthorizedKeysDir(dir)
+	local := &testConnMeta{"alex", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2000}}
+
+	perms, err := keys.Auth(local, forced.PublicKey())
+
+	if err != nil {
+		t.Fatal("key should be authorized", err)
+	}
+
+	if cmd, ok := ForcedCommand(perms); !ok || cmd != "echo forced" {
+		t.Fatalf("expected forced command, got '%s'", cmd)
+	}
+
+	if Permitted(perms, PermitPty) || !Permitted(perms, PermitPortForwarding) {
+		t.Fatal("expected no-pty to only restrict pty", perms.Extensions)
+	}
+
+	if !PermitOpen(perms, "127.0.0.1", 80) || PermitOpen(perms, "127.0.0.1", 81) {
+		t.Fatal("expected permitopen to restrict forwards", perms.CriticalOptions)
+	}
+
+	perms, err = keys.Auth(local, restricted.PublicKey())
+
+	if err != nil {
+		t.Fatal("key should be authorized", err)
+	}
+
+	if !Permitted(perms, PermitPty) || !Permitted(perms, PermitPortForwarding) || Permitted(perms, PermitAgentForwarding) {
+		t.Fatal("expected options after restrict to permit only pty and port forwarding", perms.Extensions)
+	}
+
+	if _, err := keys.Auth(local, remote.PublicKey()); err != ErrSourceNotAllowed {
+		t.Fatal("expected key to be refused from source", err)
+	}
+
+	if _, err := keys.Auth(&testConnMeta{"alex", &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}}, remote.PublicKey()); err != nil {
+		t.Fatal("expected key to be allowed from source", err)
+	}
+
+	if _, err := keys.Auth(&testConnMeta{"alex", &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}}, remote.PublicKey()); err != ErrSourceNotAllowed {
+		t.Fatal("expected negated source to be refused", err)
+	}
+
+	if _, err := keys.Auth(&testConnMeta{"bob", local.addr}, forced.PublicKey()); err == nil {
+		t.Fatal("expected key to be refused for another user")
+	}
+
+	if _, err := keys.Auth(local, later.PublicKey()); err != ErrUnauthorizedKey {
+		t.Fatal("expected unknown key to be refused", err)
+	}
+
+	writeAuthorizedKeys(t, file, now.Add(time.Second), string(ssh.MarshalAuthorizedKey(later.PublicKey())))
+
+	perms, err = keys.Auth(local, later.PublicKey())
+
+	if err != nil {
+		t.Fatal("expected changed file to be reloaded", err)
+	}
+
+	if !Permitted(perms, PermitPty) {
+		t.Fatal("expected key without options to be unrestricted", perms.Extensions)
+	}
+
+	if _, err := keys.Auth(local, forced.PublicKey()); err != ErrUnauthorizedKey {
+		t.Fatal("expected removed key to be refused", err)
+	}
+}
+
+func TestAuthorizedKeysUnsupportedOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authkeys")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	authority, expiring, plain := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	file := filepath.Join(dir, "alex")
+
+	writeAuthorizedKeys(t, file, time.Now(),
+		`cert-authority `+string(ssh.MarshalAuthorizedKey(authority.PublicKey())),
+		`no-pty,expiry-time="20990101" `+string(ssh.MarshalAuthorizedKey(expiring.PublicKey())),
+		string(ssh.MarshalAuthorizedKey(plain.PublicKey())),
+	)
+
+	keys := AuthorizedKeysDir(dir)
+	local := &testConnMeta{"alex", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2000}}
+
+	if _, err := keys.Auth(local, authority.PublicKey()); err != ErrUnauthorizedKey {
+		t.Fatal("expected cert-authority key to be skipped", err)
+	}
+
+	if _, err := keys.Auth(local, expiring.PublicKey()); err != ErrUnauthorizedKey {
+		t.Fatal("expected expiry-time key to be skipped", err)
+	}
+
+	if _, err := keys.Auth(local, plain.PublicKey()); err != nil {
+		t.Fatal("expected keys after the skipped ones to be authorized", err)
+	}
+}
+
+func TestAuthorizedKeysProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authkeys")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	signer := newTestSigner(t)
+	file := filepath.Join(dir, "authorized_keys")
+
+	writeAuthorizedKeys(t, file, time.Now(), `command="echo forced $SSH_ORIGINAL_COMMAND",no-pty `+string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	conf := NewRouteConfig(0, -1, func(act flux.ActionInterface) {})
+	port := freePort(t)
+
+	serv := RSASSHProtocol(conf, "io", "127.0.0.1", port, "./perm/perm", AuthorizedKeysFile(file).Auth)
+	defer serv.Drop()
+
+	AddPtyBehaviour(serv)
+	AddExecBehaviour(serv)
+
+	go serv.Dial()
+
+	client := dialSSHProtocol(t, port, ssh.PublicKeys(signer))
+	defer client.Close()
+
+	session, err := client.NewSession()
+
+	if err != nil {
+		t.Fatal("unable to create session", err)
+	}
+
+	defer session.Close()
+
+	if err := session.RequestPty("xterm", 40, 80, ssh.TerminalModes{}); err == nil {
+		t.Fatal("expected pty to be refused for no-pty key")
+	}
+
+	out, err := session.Output("echo requested")
+
+	if err != nil {
+		t.Fatal("unable to run command", err)
+	}
+
+	if string(out) != "forced echo requested\n" {
+		t.Fatalf("expected forced command output, got '%s'", out)
+	}
+}
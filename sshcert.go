@@ -0,0 +1,249 @@
+package servicedrop
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//SourceAddressOption is the critical option of the comma separated cidr
+//blocks a certificate can be used from
+const SourceAddressOption = "source-address"
+
+//ErrUnknownAuthority is returned for certificates not signed by a trusted authority
+var ErrUnknownAuthority = errors.New("certificate not signed by a trusted authority")
+
+//ErrNoPrincipals is returned for certificates without principals which are
+//refused rather than being valid for every user
+var ErrNoPrincipals = errors.New("certificate has no principals")
+
+//ErrNotCertificate is returned for certificate files holding plain keys
+var ErrNotCertificate = errors.New("key is not a certificate")
+
+//SSHCertAuth authenticates OpenSSH user certificates signed by the trusted
+//authorities, the certificate must hold one of the principals of the user
+//which are the user's name unless Principals is set, plain keys are passed to
+//the Fallback if any
+type SSHCertAuth struct {
+	Authorities []ssh.PublicKey
+	Principals  func(user string) []string
+	Fallback    KeyAuth
+	checker     *ssh.CertChecker
+	once        sync.Once
+}
+
+//NewSSHCertAuth returns the certificate authentication trusting the authorities
+func NewSSHCertAuth(authorities ...ssh.PublicKey) *SSHCertAuth {
+	return &SSHCertAuth{Authorities: authorities}
+}
+
+//certChecker returns the checker of the certificates, built on first use so
+//the SSHCertAuth can also be declared directly
+func (c *SSHCertAuth) certChecker() *ssh.CertChecker {
+	c.once.Do(func() {
+		c.checker = &ssh.CertChecker{
+			IsUserAuthority: c.trusted,
+			SupportedCriticalOptions: []string{
+				ForceCommandOption,
+				SourceAddressOption,
+			},
+		}
+	})
+
+	return c.checker
+}
+
+//trusted returns true if the key is one of the authorities
+func (c *SSHCertAuth) trusted(auth ssh.PublicKey) bool {
+	return isAuthority(c.Authorities, auth)
+}
+
+//isAuthority returns true if the key is within the authorities
+func isAuthority(authorities []ssh.PublicKey, auth ssh.PublicKey) bool {
+	wire := auth.Marshal()
+
+	for _, key := range authorities {
+		if bytes.Equal(key.Marshal(), wire) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Auth authenticates the certificate of the connection, it can be used as the
+//KeyAuth of RSASSHProtocol and returns the certificate's critical options and
+//extensions as the permissions
+func (c *SSHCertAuth) Auth(meta ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := pub.(*ssh.Certificate)
+
+	if !ok {
+		if c.Fallback != nil {
+			return c.Fallback(meta, pub)
+		}
+		return nil, ErrUnauthorizedKey
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate type %d is not a user certificate", cert.CertType)
+	}
+
+	if !c.trusted(cert.SignatureKey) {
+		return nil, ErrUnknownAuthority
+	}
+
+	//CheckCert skips the principal check of certificates without principals
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, ErrNoPrincipals
+	}
+
+	principals := []string{meta.User()}
+
+	if c.Principals != nil {
+		principals = c.Principals(meta.User())
+	}
+
+	checker := c.certChecker()
+	err := ErrUnauthorizedKey
+
+	for _, principal := range principals {
+		if err = checker.CheckCert(principal, cert); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if from, ok := cert.CriticalOptions[SourceAddressOption]; ok {
+		if !matchSource(strings.Split(from, ","), remoteIP(meta.RemoteAddr())) {
+			return nil, ErrSourceNotAllowed
+		}
+	}
+
+	//certificates without extensions are restricted so the map is always set
+	perms := &ssh.Permissions{
+		CriticalOptions: make(map[string]string),
+		Extensions:      make(map[string]string),
+	}
+
+	for k, v := range cert.CriticalOptions {
+		perms.CriticalOptions[k] = v
+	}
+
+	for k, v := range cert.Extensions {
+		perms.Extensions[k] = v
+	}
+
+	return perms, nil
+}
+
+//UseHostCertificate presents the host certificate of the private key to clients
+//alongside the plain host key
+func (s *SSHProtocol) UseHostCertificate(keyFile, certFile string) error {
+	pbytes, err := ioutil.ReadFile(keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	private, err := ssh.ParsePrivateKey(pbytes)
+
+	if err != nil {
+		return err
+	}
+
+	cert, err := readCertificate(certFile)
+
+	if err != nil {
+		return err
+	}
+
+	signer, err := ssh.NewCertSigner(cert, private)
+
+	if err != nil {
+		return err
+	}
+
+	s.ServerConf.AddHostKey(signer)
+	return nil
+}
+
+//readCertificate reads the certificate of an OpenSSH -cert.pub file
+func readCertificate(certFile string) (*ssh.Certificate, error) {
+	cbytes, err := ioutil.ReadFile(certFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(cbytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+
+	if !ok {
+		return nil, ErrNotCertificate
+	}
+
+	return cert, nil
+}
+
+//SignUserCert signs a user certificate of the key for the principals valid from
+//now for the duration, the options are set as critical options and the
+//certificate gets the default permit extensions
+func SignUserCert(ca ssh.Signer, pub ssh.PublicKey, id string, principals []string, valid time.Duration, options map[string]string) (*ssh.Certificate, error) {
+	extensions := make(map[string]string)
+
+	for _, ext := range defaultPermits {
+		extensions[ext] = ""
+	}
+
+	return signCert(ca, &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           id,
+		ValidPrincipals: principals,
+		Permissions: ssh.Permissions{
+			CriticalOptions: options,
+			Extensions:      extensions,
+		},
+	}, valid)
+}
+
+//SignHostCert signs a host certificate of the key for the host names valid
+//from now for the duration
+func SignHostCert(ca ssh.Signer, pub ssh.PublicKey, id string, hosts []string, valid time.Duration) (*ssh.Certificate, error) {
+	return signCert(ca, &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.HostCert,
+		KeyId:           id,
+		ValidPrincipals: hosts,
+	}, valid)
+}
+
+//signCert sets the validity window of the certificate and signs it, the window
+//starts a minute early to allow for clock skew
+func signCert(ca ssh.Signer, cert *ssh.Certificate, valid time.Duration) (*ssh.Certificate, error) {
+	now := time.Now()
+
+	cert.ValidAfter = uint64(now.Add(-time.Minute).Unix())
+	cert.ValidBefore = uint64(now.Add(valid).Unix())
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,255 @@
+package servicedrop
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHCertAuth(t *testing.T) {
+	ca, other, user := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	auth := NewSSHCertAuth(ca.PublicKey())
+	local := &testConnMeta{"alex", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2000}}
+
+	cert, err := SignUserCert(ca, user.PublicKey(), "alex@ci", []string{"alex"}, time.Hour, map[string]string{
+		ForceCommandOption: "uptime",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perms, err := auth.Auth(local, cert)
+
+	if err != nil {
+		t.Fatal("expected certificate to be authorized", err)
+	}
+
+	if cmd, ok := ForcedCommand(perms); !ok || cmd != "uptime" {
+		t.Fatalf("expected forced command, got '%s'", cmd)
+	}
+
+	if !Permitted(perms, PermitPty) {
+		t.Fatal("expected default extensions", perms.Extensions)
+	}
+
+	if _, err := auth.Auth(&testConnMeta{"bob", local.addr}, cert); err == nil {
+		t.Fatal("expected certificate to be refused for other principals")
+	}
+
+	auth.Principals = func(user string) []string {
+		return []string{user, "alex"}
+	}
+
+	if _, err := auth.Auth(&testConnMeta{"bob", local.addr}, cert); err != nil {
+		t.Fatal("expected mapped principal to be authorized", err)
+	}
+
+	untrusted, err := SignUserCert(other, user.PublicKey(), "alex@ci", []string{"alex"}, time.Hour, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Auth(local, untrusted); err != ErrUnknownAuthority {
+		t.Fatal("expected untrusted authority to be refused", err)
+	}
+
+	expired, err := SignUserCert(ca, user.PublicKey(), "alex@ci", []string{"alex"}, -time.Second, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Auth(local, expired); err == nil {
+		t.Fatal("expected expired certificate to be refused")
+	}
+
+	sourced, err := SignUserCert(ca, user.PublicKey(), "alex@ci", []string{"alex"}, time.Hour, map[string]string{
+		SourceAddressOption: "10.0.0.0/8",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Auth(local, sourced); err != ErrSourceNotAllowed {
+		t.Fatal("expected certificate to be refused from source", err)
+	}
+
+	unsupported, err := SignUserCert(ca, user.PublicKey(), "alex@ci", []string{"alex"}, time.Hour, map[string]string{
+		"verify-required": "",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Auth(local, unsupported); err == nil {
+		t.Fatal("expected unsupported critical option to be refused")
+	}
+
+	opens, err := SignUserCert(ca, user.PublicKey(), "alex@ci", []string{"alex"}, time.Hour, map[string]string{
+		PermitOpenOption: "127.0.0.1:80",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Auth(local, opens); err == nil {
+		t.Fatal("expected permitopen critical option to be refused")
+	}
+
+	anyone, err := SignUserCert(ca, user.PublicKey(), "alex@ci", nil, time.Hour, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Auth(local, anyone); err != ErrNoPrincipals {
+		t.Fatal("expected certificate without principals to be refused", err)
+	}
+
+	if _, err := auth.Auth(local, user.PublicKey()); err != ErrUnauthorizedKey {
+		t.Fatal("expected plain key without fallback to be refused", err)
+	}
+}
+
+func TestSSHCertAuthLiteral(t *testing.T) {
+	ca, user := newTestSigner(t), newTestSigner(t)
+	auth := &SSHCertAuth{Authorities: []ssh.PublicKey{ca.PublicKey()}}
+	local := &testConnMeta{"alex", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2000}}
+
+	cert, err := SignUserCert(ca, user.PublicKey(), "alex@ci", []string{"alex"}, time.Hour, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Auth(local, cert); err != nil {
+		t.Fatal("expected certificate to be authorized", err)
+	}
+
+	unsupported, err := SignUserCert(ca, user.PublicKey(), "alex@ci", []string{"alex"}, time.Hour, map[string]string{
+		"verify-required": "",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Auth(local, unsupported); err == nil {
+		t.Fatal("expected unsupported critical option to be refused")
+	}
+}
+
+func TestSSHCertLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcert")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	ca := newTestSigner(t)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := ssh.NewSignerFromKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userCert, err := SignUserCert(ca, user.PublicKey(), "alex@ci", []string{"alex"}, time.Hour, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := ssh.ParsePrivateKey(mustRead(t, "./perm/perm"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostCert, err := SignHostCert(ca, host.PublicKey(), "io", []string{"127.0.0.1"}, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "id")
+	userCertFile := filepath.Join(dir, "id-cert.pub")
+	hostCertFile := filepath.Join(dir, "host-cert.pub")
+
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	ioutil.WriteFile(userCertFile, ssh.MarshalAuthorizedKey(userCert), 0600)
+	ioutil.WriteFile(hostCertFile, ssh.MarshalAuthorizedKey(hostCert), 0600)
+
+	conf := NewRouteConfig(0, -1, func(act flux.ActionInterface) {})
+	port := freePort(t)
+
+	serv := RSASSHProtocol(conf, "io", "127.0.0.1", port, "./perm/perm", NewSSHCertAuth(ca.PublicKey()).Auth)
+	defer serv.Drop()
+
+	if err := serv.UseHostCertificate("./perm/perm", hostCertFile); err != nil {
+		t.Fatal("unable to use host certificate", err)
+	}
+
+	go serv.Dial()
+
+	link := CertSSHProtocolLink("io", "127.0.0.1", port, "alex", keyFile, userCertFile)
+	link.TrustHostAuthority(ca.PublicKey())
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for link.Dial() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("unable to connect with certificates")
+		}
+
+		<-time.After(20 * time.Millisecond)
+	}
+
+	link.Drop()
+
+	untrusted := CertSSHProtocolLink("io", "127.0.0.1", port, "alex", keyFile, userCertFile)
+	untrusted.TrustHostAuthority(newTestSigner(t).PublicKey())
+
+	if err := untrusted.Dial(); err == nil {
+		untrusted.Drop()
+		t.Fatal("expected host signed by an untrusted authority to be refused")
+	}
+}
+
+func mustRead(t *testing.T, file string) []byte {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
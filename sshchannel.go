@@ -0,0 +1,372 @@
+package servicedrop
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kr/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+//signalNames are the ssh names of the signals which can end a command
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+//ErrUnknownSignal is returned for signal requests with an unknown signal name
+var ErrUnknownSignal = errors.New("unknown signal")
+
+//ErrNoCommand is returned for signal requests on channels without a running command
+var ErrNoCommand = errors.New("no command running")
+
+//ChannelRequestWait is how long a channel waits on a request to be handled
+//before serving its next request
+var ChannelRequestWait = 2 * time.Second
+
+//AllowedEnvironment are the names of the variables which env requests can set,
+//the LC_ locale variables are always allowed
+var AllowedEnvironment = map[string]bool{
+	"LANG":     true,
+	"LANGUAGE": true,
+	"TZ":       true,
+}
+
+//defaultPath is the PATH of the channel's commands when the server has none
+const defaultPath = "/usr/local/bin:/usr/bin:/bin"
+
+//AllowEnvironment returns true if env requests can set the variable
+func AllowEnvironment(name string) bool {
+	return AllowedEnvironment[name] || strings.HasPrefix(name, "LC_")
+}
+
+//SignalByName returns the signal with the ssh name eg. 'INT'
+func SignalByName(name string) (syscall.Signal, bool) {
+	for sig, n := range signalNames {
+		if n == name {
+			return sig, true
+		}
+	}
+
+	return 0, false
+}
+
+//envMsg is the payload of an env channel request
+type envMsg struct {
+	Name  string
+	Value string
+}
+
+//signalMsg is the payload of a signal channel request
+type signalMsg struct {
+	Signal string
+}
+
+//exitStatusMsg is the payload of an exit-status channel request
+type exitStatusMsg struct {
+	Status uint32
+}
+
+//exitSignalMsg is the payload of an exit-signal channel request
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+//RequestOnce handles a channel request once and tells the channel once it was
+//handled
+type RequestOnce struct {
+	once *sync.Once
+	done chan struct{}
+}
+
+//NewRequestOnce returns a RequestOnce for a new request
+func NewRequestOnce() *RequestOnce {
+	return &RequestOnce{new(sync.Once), make(chan struct{})}
+}
+
+//Do calls the function if it is the first call for the request, as sync.Once
+//does, and marks the request as handled once the function returns
+func (o *RequestOnce) Do(fx func()) {
+	o.once.Do(func() {
+		defer close(o.done)
+		fx()
+	})
+}
+
+//Done returns a channel closed once the request was handled
+func (o *RequestOnce) Done() <-chan struct{} {
+	return o.done
+}
+
+//ChannelState is the state shared by the requests of a single session channel,
+//the pty is only opened once the channel receives a pty-req
+type ChannelState struct {
+	Conn *ssh.ServerConn
+	Pty  *Pty
+	Term string
+	Cmd  *exec.Cmd
+	env  []string
+	lock *sync.Mutex
+}
+
+//NewChannelState returns the state for a channel of the connection
+func NewChannelState(conn *ssh.ServerConn) *ChannelState {
+	return &ChannelState{Conn: conn, lock: new(sync.Mutex)}
+}
+
+//OpenPty returns the pty of the channel, opening it on the first call
+func (c *ChannelState) OpenPty() (*Pty, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.Pty != nil {
+		return c.Pty, nil
+	}
+
+	fd, tty, err := pty.Open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.Pty = &Pty{tty, fd}
+	return c.Pty, nil
+}
+
+//Terminal returns the pty of the channel or nil if none was requested
+func (c *ChannelState) Terminal() *Pty {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Pty
+}
+
+//Command returns the command running within the channel
+func (c *ChannelState) Command() *exec.Cmd {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Cmd
+}
+
+//SetEnv adds the variable into the environment of the channel's commands, it
+//returns false if the variable is not allowed
+func (c *ChannelState) SetEnv(name, value string) bool {
+	if !AllowEnvironment(name) {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.env = append(c.env, name+"="+value)
+	return true
+}
+
+//SetTerm sets the terminal type requested with the pty, xterm is used if the
+//pty named no terminal
+func (c *ChannelState) SetTerm(term string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if term == "" {
+		term = "xterm"
+	}
+
+	c.Term = term
+}
+
+//Environ returns the environment of the channel's commands, which is a PATH,
+//the server's HOME and the connection's USER with the TERM of the pty once one
+//was requested and the variables set with env requests, the rest of the
+//server's own environment is not passed on
+func (c *ChannelState) Environ() []string {
+	var user string
+
+	if c.Conn != nil {
+		user = c.Conn.User()
+	}
+
+	env := baseEnviron(user)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.Term != "" {
+		env = append(env, "TERM="+c.Term)
+	}
+
+	return append(env, c.env...)
+}
+
+//baseEnviron returns the minimal environment of the commands run for the user
+func baseEnviron(user string) []string {
+	path := os.Getenv("PATH")
+
+	if path == "" {
+		path = defaultPath
+	}
+
+	env := []string{"PATH=" + path}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		env = append(env, "HOME="+home)
+	}
+
+	return append(env, "USER="+user)
+}
+
+//Signal delivers the signal with the ssh name to the command running within
+//the channel
+func (c *ChannelState) Signal(name string) error {
+	sig, ok := SignalByName(name)
+
+	if !ok {
+		return ErrUnknownSignal
+	}
+
+	cmd := c.Command()
+
+	if cmd == nil || cmd.Process == nil {
+		return ErrNoCommand
+	}
+
+	return cmd.Process.Signal(sig)
+}
+
+//Permissions returns the permissions the channel's connection was authenticated with
+func (c *ChannelState) Permissions() *ssh.Permissions {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.Permissions
+}
+
+//Close closes the pty of the channel if one was opened
+func (c *ChannelState) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.Pty != nil {
+		c.Pty.Tty.Close()
+		c.Pty.Pfd.Close()
+	}
+}
+
+//StartChannelCommand runs the command for the channel, on the channel's pty if
+//one was requested or else with pipes sending its stderr as extended data, the
+//channel is closed after sending its exit-status or exit-signal once the
+//command exits
+func StartChannelCommand(cpay *ChannelPayload, cmd *exec.Cmd) error {
+	state := cpay.State
+	tty := state.Terminal()
+
+	var wait sync.WaitGroup
+
+	if tty != nil {
+		if err := PtyRun(cmd, tty.Tty); err != nil {
+			return err
+		}
+
+		go io.Copy(tty.Pfd, cpay.Chan)
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			io.Copy(cpay.Chan, tty.Pfd)
+		}()
+	} else {
+		stdin, err := cmd.StdinPipe()
+
+		if err != nil {
+			return err
+		}
+
+		cmd.Stdout = cpay.Chan
+		cmd.Stderr = cpay.Chan.Stderr()
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		go func() {
+			io.Copy(stdin, cpay.Chan)
+			stdin.Close()
+		}()
+	}
+
+	state.lock.Lock()
+	state.Cmd = cmd
+	state.lock.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+
+		if err != nil {
+			log.Printf("Command exited with (%s)", err)
+		}
+
+		//the pty output ends once the exited command's terminal is closed
+		wait.Wait()
+		SendExitStatus(cpay.Chan, cmd)
+		cpay.Chan.Close()
+		log.Printf("Session closed")
+	}()
+
+	return nil
+}
+
+//SendExitStatus sends the exit-status of the exited command into the channel or
+//its exit-signal if it was ended by a signal
+func SendExitStatus(ch ssh.Channel, cmd *exec.Cmd) error {
+	if cmd.ProcessState == nil {
+		return nil
+	}
+
+	ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+
+	if !ok {
+		_, err := ch.SendRequest("exit-status", false, ssh.Marshal(&exitStatusMsg{1}))
+		return err
+	}
+
+	if ws.Signaled() {
+		name, ok := signalNames[ws.Signal()]
+
+		if ok {
+			_, err := ch.SendRequest("exit-signal", false, ssh.Marshal(&exitSignalMsg{
+				name,
+				ws.CoreDump(),
+				ws.Signal().String(),
+				"",
+			}))
+			return err
+		}
+
+		//signals without a ssh name are reported as the shell does
+		_, err := ch.SendRequest("exit-status", false, ssh.Marshal(&exitStatusMsg{uint32(128 + ws.Signal())}))
+		return err
+	}
+
+	_, err := ch.SendRequest("exit-status", false, ssh.Marshal(&exitStatusMsg{uint32(ws.ExitStatus())}))
+	return err
+}
@@ -0,0 +1,384 @@
+package servicedrop
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+	"golang.org/x/crypto/ssh"
+)
+
+func freePort(t *testing.T) int {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ls.Close()
+	return ls.Addr().(*net.TCPAddr).Port
+}
+
+func dialSSHProtocol(t *testing.T, port int, auth ...ssh.AuthMethod) *ssh.Client {
+	if len(auth) == 0 {
+		auth = []ssh.AuthMethod{ssh.Password("secret")}
+	}
+
+	conf := &ssh.ClientConfig{
+		User: "alex",
+		Auth: auth,
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			return nil
+		},
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		client, err := ssh.Dial("tcp", addr, conf)
+
+		if err == nil {
+			return client
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("unable to connect to ssh-server", err)
+		}
+
+		<-time.After(20 * time.Millisecond)
+	}
+}
+
+func startExecProtocol(t *testing.T, setup ...func(*SSHProtocol)) (*SSHProtocol, int) {
+	return startExecProtocolConf(t, NewRouteConfig(0, -1, func(act flux.ActionInterface) {}), setup...)
+}
+
+func startExecProtocolConf(t *testing.T, conf *RouteConfig, setup ...func(*SSHProtocol)) (*SSHProtocol, int) {
+	port := freePort(t)
+
+	serv := PasswordSSHProtocol(conf, "io", "127.0.0.1", port, "./perm/perm", func(c ssh.ConnMetadata, b []byte) (*ssh.Permissions, error) {
+		return nil, nil
+	})
+
+	AddExecBehaviour(serv)
+	AddEnvBehaviour(serv)
+	AddSignalBehaviour(serv)
+
+	for _, fx := range setup {
+		fx(serv)
+	}
+
+	go serv.Dial()
+	return serv, port
+}
+
+func TestSSHExitStatus(t *testing.T) {
+	serv, port := startExecProtocol(t)
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	session, err := client.NewSession()
+
+	if err != nil {
+		t.Fatal("unable to create session", err)
+	}
+
+	defer session.Close()
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	err = session.Run("echo out; echo err >&2; exit 3")
+
+	exit, ok := err.(*ssh.ExitError)
+
+	if !ok {
+		t.Fatal("command did not return an exit error", err)
+	}
+
+	if exit.ExitStatus() != 3 {
+		t.Fatalf("incorrect exit status: %d", exit.ExitStatus())
+	}
+
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Fatalf("incorrect command output: stdout %q stderr %q", stdout, stderr)
+	}
+}
+
+func TestSSHExitSignal(t *testing.T) {
+	serv, port := startExecProtocol(t)
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	session, err := client.NewSession()
+
+	if err != nil {
+		t.Fatal("unable to create session", err)
+	}
+
+	defer session.Close()
+
+	err = session.Run("kill -TERM $$")
+
+	exit, ok := err.(*ssh.ExitError)
+
+	if !ok {
+		t.Fatal("command did not return an exit error", err)
+	}
+
+	if exit.Signal() != "TERM" {
+		t.Fatalf("incorrect exit signal: %q", exit.Signal())
+	}
+}
+
+func TestSSHEnvRequests(t *testing.T) {
+	serv, port := startExecProtocol(t)
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	session, err := client.NewSession()
+
+	if err != nil {
+		t.Fatal("unable to create session", err)
+	}
+
+	defer session.Close()
+
+	if err := session.Setenv("LANG", "C"); err != nil {
+		t.Fatal("allowed variable was refused", err)
+	}
+
+	if err := session.Setenv("LD_PRELOAD", "/tmp/evil.so"); err == nil {
+		t.Fatal("variable outside the allowlist was accepted")
+	}
+
+	//TERM is only set once a pty is requested, the shell itself may default it
+	out, err := session.Output("echo $LANG; env | grep -c ^TERM= || true")
+
+	if err != nil {
+		t.Fatal("command failed", err)
+	}
+
+	if string(out) != "C\n0\n" {
+		t.Fatalf("incorrect command environment: %q", out)
+	}
+}
+
+func TestSSHCommandEnvironment(t *testing.T) {
+	os.Setenv("SERVICEDROP_SECRET", "leaked")
+	defer os.Unsetenv("SERVICEDROP_SECRET")
+
+	serv, port := startExecProtocol(t, AddShellBehaviour)
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	const script = `echo "$USER:$SERVICEDROP_SECRET"; test -n "$PATH" && test -n "$HOME" && echo base`
+
+	session, err := client.NewSession()
+
+	if err != nil {
+		t.Fatal("unable to create session", err)
+	}
+
+	out, err := session.Output(script)
+	session.Close()
+
+	if err != nil {
+		t.Fatal("command failed", err)
+	}
+
+	if string(out) != "alex:\nbase\n" {
+		t.Fatalf("incorrect exec environment: %q", out)
+	}
+
+	session, err = client.NewSession()
+
+	if err != nil {
+		t.Fatal("unable to create session", err)
+	}
+
+	defer session.Close()
+
+	var shellOut bytes.Buffer
+
+	session.Stdin = strings.NewReader(script + "\nexit\n")
+	session.Stdout = &shellOut
+
+	if err := session.Shell(); err != nil {
+		t.Fatal("unable to start shell", err)
+	}
+
+	if err := session.Wait(); err != nil {
+		t.Fatal("shell failed", err)
+	}
+
+	if shellOut.String() != "alex:\nbase\n" {
+		t.Fatalf("incorrect shell environment: %q", shellOut.String())
+	}
+}
+
+func TestSSHSignalRequest(t *testing.T) {
+	serv, port := startExecProtocol(t)
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	session, err := client.NewSession()
+
+	if err != nil {
+		t.Fatal("unable to create session", err)
+	}
+
+	defer session.Close()
+
+	if err := session.Start("exec sleep 5"); err != nil {
+		t.Fatal("unable to start command", err)
+	}
+
+	if err := session.Signal(ssh.SIGINT); err != nil {
+		t.Fatal("unable to send signal", err)
+	}
+
+	exit, ok := session.Wait().(*ssh.ExitError)
+
+	if !ok || exit.Signal() != "INT" {
+		t.Fatal("command was not ended by the signal", exit)
+	}
+}
+
+//sendChannelRequests opens a session channel and sends the requests without
+//waiting on their replies, returning the output of the channel
+func sendChannelRequests(t *testing.T, client *ssh.Client, reqs ...func(ssh.Channel) error) string {
+	ch, in, err := client.OpenChannel("session", nil)
+
+	if err != nil {
+		t.Fatal("unable to open session channel", err)
+	}
+
+	defer ch.Close()
+	go ssh.DiscardRequests(in)
+
+	for _, req := range reqs {
+		if err := req(ch); err != nil {
+			t.Fatal("unable to send request", err)
+		}
+	}
+
+	out := make(chan []byte, 1)
+
+	go func() {
+		data, _ := ioutil.ReadAll(ch)
+		out <- data
+	}()
+
+	select {
+	case data := <-out:
+		return string(data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel did not close")
+	}
+
+	return ""
+}
+
+func execRequest(command string) func(ssh.Channel) error {
+	return func(ch ssh.Channel) error {
+		_, err := ch.SendRequest("exec", false, ssh.Marshal(&struct{ Command string }{command}))
+		return err
+	}
+}
+
+func TestSSHRequestOrder(t *testing.T) {
+	conf := NewRouteConfig(0, -1, func(act flux.ActionInterface) {}).WithPriority(&RoutePriority{time.Second})
+
+	//a slow pty-req must still be handled before the exec sent right after it
+	slowPty := func(s *SSHProtocol) {
+		s.Routes().Child("session/pty-req").Sub(func(req *Request, _ *flux.Sub) {
+			payload, ok := req.Payload.(*PayloadRack)
+
+			if !ok {
+				return
+			}
+
+			payload.Release().When(func(d interface{}, _ flux.ActionInterface) {
+				cpay, ok := d.(*ChannelPayload)
+
+				if !ok {
+					return
+				}
+
+				cpay.Do.Do(func() {
+					<-time.After(100 * time.Millisecond)
+
+					if _, err := cpay.State.OpenPty(); err == nil {
+						cpay.State.SetTerm("vt100")
+					}
+				})
+			})
+		})
+	}
+
+	serv, port := startExecProtocolConf(t, conf, slowPty)
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	ptyReq := func(ch ssh.Channel) error {
+		_, err := ch.SendRequest("pty-req", false, ssh.Marshal(&struct {
+			Term                         string
+			Columns, Rows, Width, Height uint32
+			Modes                        string
+		}{"vt100", 80, 24, 0, 0, ""}))
+		return err
+	}
+
+	out := sendChannelRequests(t, client, ptyReq, execRequest("tty; echo $TERM"))
+
+	if !strings.Contains(out, "/dev/") || !strings.Contains(out, "vt100") {
+		t.Fatalf("exec ran before its pty was opened: %q", out)
+	}
+}
+
+func TestSSHEnvBeforeExec(t *testing.T) {
+	conf := NewRouteConfig(0, -1, func(act flux.ActionInterface) {}).WithPriority(&RoutePriority{time.Second})
+
+	serv, port := startExecProtocolConf(t, conf)
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	env := func(name, value string) func(ssh.Channel) error {
+		return func(ch ssh.Channel) error {
+			_, err := ch.SendRequest("env", false, ssh.Marshal(&envMsg{name, value}))
+			return err
+		}
+	}
+
+	//the env requests are applied before the exec sent right after them
+	for i := 0; i < 5; i++ {
+		out := sendChannelRequests(t, client, env("LANG", "C"), env("TZ", "UTC"), execRequest("echo $LANG $TZ"))
+
+		if out != "C UTC\n" {
+			t.Fatalf("exec ran before its env requests were applied: %q", out)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package servicedrop
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//ForwardPolicy decides if the user can forward connections to the host and port
+type ForwardPolicy func(user, host string, port uint32) bool
+
+//ChannelHandler handles the new channels of a type which are not served through
+//the route tree, the channel is counted against the channel limits until it returns
+type ChannelHandler func(*ssh.ServerConn, ssh.NewChannel, *SessionMeter)
+
+//RequestHandler handles the global requests of a type, returning the reply
+type RequestHandler func(*ssh.ServerConn, *ssh.Request, *SessionMeter) (bool, []byte)
+
+//AddRequestHandler sets the handler for the global requests of the type, it
+//should be called before the protocol is dialed
+func AddRequestHandler(s *SSHProtocol, rtype string, handle RequestHandler) {
+	s.requests[rtype] = handle
+}
+
+//AddChannelHandler sets the handler for the new channels of the type, it
+//should be called before the protocol is dialed
+func AddChannelHandler(s *SSHProtocol, stype string, handle ChannelHandler) {
+	s.channels[stype] = handle
+}
+
+//LoopbackBindPolicy allows remote forwards to bind only on the loopback
+//addresses and unprivileged ports
+func LoopbackBindPolicy(user, host string, port uint32) bool {
+	if port != 0 && port < 1024 {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+//ForwardAllowlist returns a policy allowing each user the destinations within
+//their list, destinations are 'host:port' where the port can be '*' for any
+func ForwardAllowlist(allowed map[string][]string) ForwardPolicy {
+	return func(user, host string, port uint32) bool {
+		return matchDestination(allowed[user], host, port)
+	}
+}
+
+//matchDestination returns true if the host and port are within the 'host:port'
+//destinations where the port can be '*' for any
+func matchDestination(dests []string, host string, port uint32) bool {
+	for _, dest := range dests {
+		h, p, err := net.SplitHostPort(dest)
+
+		if err != nil || h != host {
+			continue
+		}
+
+		if p == "*" || p == strconv.Itoa(int(port)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//directTCPIPMsg is the extra data of a direct-tcpip channel
+type directTCPIPMsg struct {
+	Host     string
+	Port     uint32
+	OrigHost string
+	OrigPort uint32
+}
+
+//AddDirectTCPIPBehaviour allows clients to forward local ports (ssh -L) to the
+//destinations allowed by the policy and the connection's permissions, each
+//forwarded connection is proxied until both ends close
+func AddDirectTCPIPBehaviour(s *SSHProtocol, allow ForwardPolicy) {
+	AddChannelHandler(s, "direct-tcpip", func(conn *ssh.ServerConn, nc ssh.NewChannel, meter *SessionMeter) {
+		var msg directTCPIPMsg
+
+		if err := ssh.Unmarshal(nc.ExtraData(), &msg); err != nil {
+			nc.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+			return
+		}
+
+		if allow == nil || !allow(conn.User(), msg.Host, msg.Port) || !PermitOpen(conn.Permissions, msg.Host, msg.Port) {
+			log.Printf("Refusing forward for (%s) to %s:%d", conn.User(), msg.Host, msg.Port)
+			nc.Reject(ssh.Prohibited, "forwarding to destination not allowed")
+			return
+		}
+
+		dest, err := net.DialTimeout("tcp", net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port))), 10*time.Second)
+
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+
+		ch, reqs, err := nc.Accept()
+
+		if err != nil {
+			log.Println("Error accepting channel: ", err)
+			dest.Close()
+			return
+		}
+
+		go ssh.DiscardRequests(reqs)
+
+		s.emitConn(SessionChannelOpened, conn, meter, "direct-tcpip", "")
+		proxyChannel(conn, meter.Channel(ch), dest)
+	})
+}
+
+//proxyChannel proxies the channel and connection with a TCPStream, the stream
+//closes the other side once either side ends and both are closed once the ssh
+//connection ends
+func proxyChannel(conn *ssh.ServerConn, ch ssh.Channel, dest net.Conn) {
+	done := make(chan struct{})
+	once := new(sync.Once)
+	end := func() { once.Do(func() { close(done) }) }
+
+	TCPStream(&channelConn{ch, conn, end}, &closeNotifyConn{dest, end}, nil, nil)
+
+	select {
+	case <-done:
+	case <-waitConn(conn):
+	}
+
+	ch.Close()
+	dest.Close()
+}
+
+//waitConn returns a channel closed once the connection ends
+func waitConn(conn ssh.Conn) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		conn.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+//channelConn adapts a ssh.Channel into a net.Conn
+type channelConn struct {
+	ssh.Channel
+	conn   ssh.Conn
+	closed func()
+}
+
+//Close closes the channel
+func (c *channelConn) Close() error {
+	defer c.closed()
+	return c.Channel.Close()
+}
+
+//LocalAddr returns the local address of the channel's connection
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+//RemoteAddr returns the remote address of the channel's connection
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+//SetDeadline is not supported by channels
+func (c *channelConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+//SetReadDeadline is not supported by channels
+func (c *channelConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+//SetWriteDeadline is not supported by channels
+func (c *channelConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+//closeNotifyConn is a net.Conn calling a function once closed
+type closeNotifyConn struct {
+	net.Conn
+	closed func()
+}
+
+//Close closes the connection
+func (c *closeNotifyConn) Close() error {
+	defer c.closed()
+	return c.Conn.Close()
+}
+
+//tcpipForwardMsg is the payload of tcpip-forward and cancel-tcpip-forward requests
+type tcpipForwardMsg struct {
+	Addr string
+	Port uint32
+}
+
+//tcpipForwardReply is the reply of a tcpip-forward request for port 0
+type tcpipForwardReply struct {
+	Port uint32
+}
+
+//forwardedTCPIPMsg is the extra data of a forwarded-tcpip channel
+type forwardedTCPIPMsg struct {
+	Addr     string
+	Port     uint32
+	OrigAddr string
+	OrigPort uint32
+}
+
+//remoteForwards holds the listeners of the remote forwards of each connection
+type remoteForwards struct {
+	listeners map[ssh.Conn]map[string]net.Listener
+	lock      *sync.Mutex
+}
+
+//add adds the listener of the connection, closing all the listeners of the
+//connection once it ends
+func (r *remoteForwards) add(conn ssh.Conn, key string, ls net.Listener) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	forwards, ok := r.listeners[conn]
+
+	if !ok {
+		forwards = make(map[string]net.Listener)
+		r.listeners[conn] = forwards
+
+		go func() {
+			conn.Wait()
+			r.closeAll(conn)
+		}()
+	}
+
+	forwards[key] = ls
+}
+
+//remove closes and removes the listener of the connection
+func (r *remoteForwards) remove(conn ssh.Conn, key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ls, ok := r.listeners[conn][key]
+
+	if !ok {
+		return false
+	}
+
+	delete(r.listeners[conn], key)
+	ls.Close()
+	return true
+}
+
+//closeAll closes and removes all listeners of the connection
+func (r *remoteForwards) closeAll(conn ssh.Conn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, ls := range r.listeners[conn] {
+		ls.Close()
+	}
+
+	delete(r.listeners, conn)
+}
+
+//AddTCPIPForwardBehaviour allows clients to forward remote ports (ssh -R) on
+//the bind addresses allowed by the policy if the connection's permissions allow
+//port forwarding, each accepted connection is sent to the client as a
+//forwarded-tcpip channel and the listeners are closed with the connection
+//which requested them
+func AddTCPIPForwardBehaviour(s *SSHProtocol, allow ForwardPolicy) {
+	forwards := &remoteForwards{make(map[ssh.Conn]map[string]net.Listener), new(sync.Mutex)}
+
+	AddRequestHandler(s, "tcpip-forward", func(conn *ssh.ServerConn, req *ssh.Request, meter *SessionMeter) (bool, []byte) {
+		var msg tcpipForwardMsg
+
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+			return false, nil
+		}
+
+		if allow == nil || !allow(conn.User(), msg.Addr, msg.Port) || !Permitted(conn.Permissions, PermitPortForwarding) {
+			log.Printf("Refusing remote forward for (%s) on %s:%d", conn.User(), msg.Addr, msg.Port)
+			return false, nil
+		}
+
+		ls, err := net.Listen("tcp", net.JoinHostPort(msg.Addr, strconv.Itoa(int(msg.Port))))
+
+		if err != nil {
+			log.Printf("Unable to listen for remote forward (%s): %+v", conn.User(), err)
+			return false, nil
+		}
+
+		port := uint32(ls.Addr().(*net.TCPAddr).Port)
+		forwards.add(conn, net.JoinHostPort(msg.Addr, strconv.Itoa(int(port))), ls)
+
+		go func() {
+			for {
+				con, err := ls.Accept()
+
+				if err != nil {
+					return
+				}
+
+				go func() {
+					orig := con.RemoteAddr().(*net.TCPAddr)
+
+					ch, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&forwardedTCPIPMsg{
+						msg.Addr,
+						port,
+						orig.IP.String(),
+						uint32(orig.Port),
+					}))
+
+					if err != nil {
+						log.Printf("Unable to open forwarded channel for (%s): %+v", conn.User(), err)
+						con.Close()
+						return
+					}
+
+					go ssh.DiscardRequests(reqs)
+
+					s.emitConn(SessionChannelOpened, conn, meter, "forwarded-tcpip", "")
+					proxyChannel(conn, meter.Channel(ch), con)
+				}()
+			}
+		}()
+
+		if msg.Port == 0 {
+			return true, ssh.Marshal(&tcpipForwardReply{port})
+		}
+
+		return true, nil
+	})
+
+	AddRequestHandler(s, "cancel-tcpip-forward", func(conn *ssh.ServerConn, req *ssh.Request, _ *SessionMeter) (bool, []byte) {
+		var msg tcpipForwardMsg
+
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+			return false, nil
+		}
+
+		return forwards.remove(conn, net.JoinHostPort(msg.Addr, strconv.Itoa(int(msg.Port)))), nil
+	})
+}
@@ -0,0 +1,215 @@
+package servicedrop
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func startEchoServer(t *testing.T) net.Listener {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			con, err := ls.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(con, con)
+				con.Close()
+			}()
+		}
+	}()
+
+	return ls
+}
+
+func TestSSHDirectTCPIP(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	serv, port := startExecProtocol(t, func(serv *SSHProtocol) {
+		AddDirectTCPIPBehaviour(serv, ForwardAllowlist(map[string][]string{
+			"alex": {fmt.Sprintf("127.0.0.1:%d", echo.Addr().(*net.TCPAddr).Port)},
+		}))
+	})
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	con, err := client.Dial("tcp", echo.Addr().String())
+
+	if err != nil {
+		t.Fatal("unable to forward to allowed destination", err)
+	}
+
+	defer con.Close()
+
+	fmt.Fprintf(con, "hello\n")
+
+	line, err := bufio.NewReader(con).ReadString('\n')
+
+	if err != nil || line != "hello\n" {
+		t.Fatalf("incorrect forwarded reply: %q %+v", line, err)
+	}
+
+	if _, err := client.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		t.Fatal("forward to a destination outside the allowlist was accepted")
+	}
+}
+
+func TestSSHDirectTCPIPDestClose(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ls.Close()
+
+	go func() {
+		con, err := ls.Accept()
+
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(con, "bye\n")
+		con.Close()
+	}()
+
+	serv, port := startExecProtocol(t, func(serv *SSHProtocol) {
+		AddDirectTCPIPBehaviour(serv, ForwardAllowlist(map[string][]string{
+			"alex": {ls.Addr().String()},
+		}))
+	})
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	con, err := client.Dial("tcp", ls.Addr().String())
+
+	if err != nil {
+		t.Fatal("unable to forward to allowed destination", err)
+	}
+
+	read := make(chan string, 1)
+
+	go func() {
+		data, _ := ioutil.ReadAll(con)
+		read <- string(data)
+	}()
+
+	select {
+	case data := <-read:
+		if data != "bye\n" {
+			t.Fatalf("incorrect forwarded data: %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("destination closing was not forwarded to the client")
+	}
+
+	con.Close()
+	waitChannelsReleased(t, serv)
+}
+
+//waitChannelsReleased waits for the forwarded channels of alex to end
+func waitChannelsReleased(t *testing.T, serv *SSHProtocol) {
+	deadline := time.Now().Add(2 * time.Second)
+
+	for serv.sessions.Claims(limitKey("user-chan", "alex")) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("forwarded channel was not closed")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+func TestForwardAllowlist(t *testing.T) {
+	allow := ForwardAllowlist(map[string][]string{
+		"alex": {"localhost:8080", "db.internal:*"},
+	})
+
+	if !allow("alex", "localhost", 8080) || !allow("alex", "db.internal", 5432) {
+		t.Fatal("allowed destinations were refused")
+	}
+
+	if allow("alex", "localhost", 22) || allow("bob", "localhost", 8080) {
+		t.Fatal("destinations outside the allowlist were allowed")
+	}
+}
+
+func TestSSHTCPIPForward(t *testing.T) {
+	serv, port := startExecProtocol(t, func(serv *SSHProtocol) {
+		AddTCPIPForwardBehaviour(serv, LoopbackBindPolicy)
+	})
+	defer serv.Drop()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	if _, err := client.Listen("tcp", "0.0.0.0:0"); err == nil {
+		t.Fatal("remote forward outside the bind policy was accepted")
+	}
+
+	ls, err := client.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("unable to request remote forward", err)
+	}
+
+	echoed := make(chan struct{})
+
+	go func() {
+		con, err := ls.Accept()
+
+		if err != nil {
+			return
+		}
+
+		io.Copy(con, con)
+		con.Close()
+		close(echoed)
+	}()
+
+	con, err := net.Dial("tcp", ls.Addr().String())
+
+	if err != nil {
+		t.Fatal("unable to connect to remote forward", err)
+	}
+
+	fmt.Fprintf(con, "hello\n")
+
+	line, err := bufio.NewReader(con).ReadString('\n')
+	con.Close()
+
+	if err != nil || line != "hello\n" {
+		t.Fatalf("incorrect forwarded reply: %q %+v", line, err)
+	}
+
+	select {
+	case <-echoed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("remote side closing was not forwarded to the client")
+	}
+
+	ls.Close()
+
+	if con, err := net.Dial("tcp", ls.Addr().String()); err == nil {
+		con.Close()
+		t.Fatal("cancelled remote forward is still listening")
+	}
+}
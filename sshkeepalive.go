@@ -0,0 +1,106 @@
+package servicedrop
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//SSHKeepAlive configures the keepalives of a SSHProtocol, a keepalive request
+//is sent every Interval and connections missing MaxMissed replies in a row are
+//disconnected as are connections whose channels had no traffic for Idle, a zero
+//Interval disables keepalives and a zero Idle disables the idle timeout
+type SSHKeepAlive struct {
+	Interval  time.Duration
+	MaxMissed int
+	Idle      time.Duration
+}
+
+//keepAlive sends the keepalives of the connection until it ends, disconnecting
+//it once it misses too many keepalives or stays idle
+func (s *SSHProtocol) keepAlive(conn *ssh.ServerConn, meter *SessionMeter) {
+	ka := s.KeepAlive
+
+	if ka == nil || (ka.Interval <= 0 && ka.Idle <= 0) {
+		return
+	}
+
+	every := ka.Interval
+
+	if every <= 0 || (ka.Idle > 0 && ka.Idle < every) {
+		every = ka.Idle
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	done := waitConn(conn)
+	replies := make(chan error, 1)
+	last := time.Now()
+
+	var missed int
+	var waiting bool
+
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-replies:
+			waiting = false
+
+			if err != nil {
+				return
+			}
+
+			missed = 0
+			continue
+		case <-ticker.C:
+		}
+
+		if ka.Idle > 0 && meter.Idle() >= ka.Idle {
+			s.timeOut(conn, meter, "idle timeout")
+			return
+		}
+
+		if ka.Interval <= 0 || time.Since(last) < ka.Interval {
+			continue
+		}
+
+		last = time.Now()
+
+		if waiting {
+			missed++
+
+			if ka.MaxMissed > 0 && missed >= ka.MaxMissed {
+				s.timeOut(conn, meter, "keepalive timeout")
+				return
+			}
+
+			continue
+		}
+
+		waiting = true
+
+		go func() {
+			//any reply including a failure shows the client is alive
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			replies <- err
+		}()
+	}
+}
+
+//timeOut disconnects the connection for the reason, the connection's
+//disconnected event carries the reason and its session is destroyed once the
+//connection ends, the client only sees the connection drop as no disconnect
+//message can be sent after the key exchange
+func (s *SSHProtocol) timeOut(conn *ssh.ServerConn, meter *SessionMeter, reason string) {
+	log.Printf("Disconnecting (%s) for user (%s): %s", conn.RemoteAddr(), conn.User(), reason)
+
+	ev := newConnEvent(SessionTimedOut, conn, meter)
+	ev.Reason = reason
+	s.sessions.Events.Emit(ev)
+
+	meter.endWith(reason)
+	conn.Close()
+}
@@ -0,0 +1,125 @@
+package servicedrop
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHIdleTimeout(t *testing.T) {
+	serv, port := startExecProtocol(t, func(serv *SSHProtocol) {
+		serv.KeepAlive = &SSHKeepAlive{Interval: 100 * time.Millisecond, MaxMissed: 5, Idle: time.Second}
+	})
+	defer serv.Drop()
+
+	reasons := make(chan string, 1)
+
+	serv.sessions.EventSub(func(ev *SessionEvent, _ *flux.Sub) {
+		if ev.Type == SessionTimedOut {
+			reasons <- ev.Reason
+		}
+	})
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	session, err := client.NewSession()
+
+	if err != nil {
+		t.Fatal("unable to create session", err)
+	}
+
+	//keepalives are answered so only the idle channels end the connection
+	<-time.After(100 * time.Millisecond)
+
+	if _, err := session.Output("echo alive"); err != nil {
+		t.Fatal("connection ended before being idle", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- client.Wait() }()
+
+	select {
+	case <-closed:
+	case <-time.After(4 * time.Second):
+		t.Fatal("idle connection was not disconnected")
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != "idle timeout" {
+			t.Fatalf("incorrect disconnect reason: %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no timed-out event was emitted")
+	}
+}
+
+func TestSSHKeepAliveMissed(t *testing.T) {
+	serv, port := startExecProtocol(t, func(serv *SSHProtocol) {
+		serv.KeepAlive = &SSHKeepAlive{Interval: 50 * time.Millisecond, MaxMissed: 3}
+	})
+	defer serv.Drop()
+
+	events := make(chan *SessionEvent, 8)
+
+	//only the events of connections ended by the server have a reason
+	serv.sessions.EventSub(func(ev *SessionEvent, _ *flux.Sub) {
+		if ev.Reason != "" {
+			events <- ev
+		}
+	})
+
+	//wait for the protocol to be listening
+	dialSSHProtocol(t, port).Close()
+
+	con, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, _, err := ssh.NewClientConn(con, con.RemoteAddr().String(), &ssh.ClientConfig{
+		User: "alex",
+		Auth: []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal("unable to connect", err)
+	}
+
+	//the keepalives are never read so they are never answered
+	defer conn.Close()
+
+	start := time.Now()
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Wait() }()
+
+	select {
+	case <-closed:
+	case <-time.After(4 * time.Second):
+		t.Fatal("connection missing keepalives was not disconnected")
+	}
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("connection was disconnected before missing 3 keepalives: %s", elapsed)
+	}
+
+	for _, kind := range []string{SessionTimedOut, SessionDisconnected} {
+		select {
+		case ev := <-events:
+			if ev.Type != kind || ev.Reason != "keepalive timeout" {
+				t.Fatalf("incorrect %s event: %+v", kind, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event was emitted", kind)
+		}
+	}
+}
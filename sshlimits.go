@@ -0,0 +1,204 @@
+package servicedrop
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//SSHDisconnectTooManyConnections is the ssh disconnect reason sent to
+//connections refused due to the connection limits
+const SSHDisconnectTooManyConnections = 12
+
+//ErrTooManyConnections is returned when a user holds its maximum connections
+var ErrTooManyConnections = errors.New("too many connections")
+
+//errUserConnections fails the authentication of users holding their maximum
+//connections, as no disconnect message can be sent once the keys are exchanged
+//its banner tells the client why it was refused
+var errUserConnections = &ssh.BannerError{Err: ErrTooManyConnections, Message: "too many connections\n"}
+
+//SSHLimits bounds the concurrent connections and channels of a SSHProtocol
+//by user and by source ip, a limit of zero or less is unlimited
+type SSHLimits struct {
+	UserConnections int
+	IPConnections   int
+	UserChannels    int
+	IPChannels      int
+}
+
+//UseLimits sets the limits of the protocol, connections above the ip limit are
+//disconnected before the key exchange and those above the user limit fail
+//authentication with a "too many connections" banner, channels above the limits
+//are rejected as a resource shortage
+func (s *SSHProtocol) UseLimits(l *SSHLimits) {
+	s.Limits = l
+
+	//the stages of NewSSHProtocol's authentication check the limits themselves
+	if s.auth != nil {
+		return
+	}
+
+	if auth := s.ServerConf.PasswordCallback; auth != nil {
+		s.ServerConf.PasswordCallback = func(meta ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if !s.allowUser(meta.User()) {
+				return nil, errUserConnections
+			}
+			return auth(meta, pass)
+		}
+	}
+
+	if auth := s.ServerConf.PublicKeyCallback; auth != nil {
+		s.ServerConf.PublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !s.allowUser(meta.User()) {
+				return nil, errUserConnections
+			}
+			return auth(meta, key)
+		}
+	}
+
+	if auth := s.ServerConf.KeyboardInteractiveCallback; auth != nil {
+		s.ServerConf.KeyboardInteractiveCallback = func(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if !s.allowUser(meta.User()) {
+				return nil, errUserConnections
+			}
+			return auth(meta, client)
+		}
+	}
+}
+
+//limits returns the limits of the protocol
+func (s *SSHProtocol) limits() *SSHLimits {
+	if s.Limits == nil {
+		return &SSHLimits{}
+	}
+	return s.Limits
+}
+
+//allowUser returns true if the user can open another connection
+func (s *SSHProtocol) allowUser(user string) bool {
+	max := s.limits().UserConnections
+	return max <= 0 || s.sessions.Claims(limitKey("user-conn", user)) < max
+}
+
+//claimAddr takes a connection from the limit of the address, disconnecting
+//the connection if the address is at its limit
+func (s *SSHProtocol) claimAddr(con net.Conn) bool {
+	if s.sessions.Claim(limitKey("ip-conn", remoteIP(con.RemoteAddr())), s.limits().IPConnections) {
+		return true
+	}
+
+	go disconnectSSH(con, s.ServerConf.ServerVersion, SSHDisconnectTooManyConnections, "too many connections")
+	return false
+}
+
+//releaseAddr gives back a connection taken with claimAddr
+func (s *SSHProtocol) releaseAddr(addr net.Addr) {
+	s.sessions.Release(limitKey("ip-conn", remoteIP(addr)))
+}
+
+//claimUser takes a connection from the limit of the connection's user and
+//releases both the user and address once the connection ends
+func (s *SSHProtocol) claimUser(conn *ssh.ServerConn) bool {
+	key := limitKey("user-conn", conn.User())
+
+	if !s.sessions.Claim(key, s.limits().UserConnections) {
+		return false
+	}
+
+	go func() {
+		conn.Wait()
+		s.sessions.Release(key)
+		s.releaseAddr(conn.RemoteAddr())
+	}()
+
+	return true
+}
+
+//claimChannel takes a channel from the limits of the connection's user and
+//address, returning the function to release it
+func (s *SSHProtocol) claimChannel(conn *ssh.ServerConn) (func(), bool) {
+	user := limitKey("user-chan", conn.User())
+	ip := limitKey("ip-chan", remoteIP(conn.RemoteAddr()))
+
+	if !s.sessions.Claim(user, s.limits().UserChannels) {
+		return nil, false
+	}
+
+	if !s.sessions.Claim(ip, s.limits().IPChannels) {
+		s.sessions.Release(user)
+		return nil, false
+	}
+
+	once := new(sync.Once)
+
+	return func() {
+		once.Do(func() {
+			s.sessions.Release(user)
+			s.sessions.Release(ip)
+		})
+	}, true
+}
+
+//limitKey returns the claim key of the id for a kind of limit
+func limitKey(kind, id string) string {
+	return kind + "/" + id
+}
+
+//remoteIP returns the host of the address without its port
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+//disconnectSSH performs the version exchange on the connection and sends a
+//cleartext ssh disconnect message with the reason before closing it, as no keys
+//have been exchanged yet
+func disconnectSSH(con net.Conn, version string, reason uint32, msg string) error {
+	defer con.Close()
+
+	con.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if version == "" {
+		version = "SSH-2.0-Go"
+	}
+
+	if _, err := con.Write([]byte(version + "\r\n")); err != nil {
+		return err
+	}
+
+	//read the client's version so it is not left unread when closing
+	if _, err := bufio.NewReader(con).ReadString('\n'); err != nil {
+		return err
+	}
+
+	payload := make([]byte, 1+4+4+len(msg)+4)
+	payload[0] = 1
+	binary.BigEndian.PutUint32(payload[1:], reason)
+	binary.BigEndian.PutUint32(payload[5:], uint32(len(msg)))
+	copy(payload[9:], msg)
+
+	padding := 8 - (5+len(payload))%8
+
+	if padding < 4 {
+		padding += 8
+	}
+
+	packet := make([]byte, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)+padding))
+	packet[4] = byte(padding)
+	copy(packet[5:], payload)
+
+	_, err := con.Write(packet)
+	return err
+}
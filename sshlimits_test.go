@@ -0,0 +1,115 @@
+package servicedrop
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influx6/flux"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHDisconnectTooManyConnections(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ls.Close()
+
+	go func() {
+		con, err := ls.Accept()
+
+		if err != nil {
+			return
+		}
+
+		disconnectSSH(con, "", SSHDisconnectTooManyConnections, "too many connections")
+	}()
+
+	con, err := net.Dial("tcp", ls.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = ssh.NewClientConn(con, ls.Addr().String(), &ssh.ClientConfig{
+		User: "alex",
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			return nil
+		},
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "too many connections") {
+		t.Fatal("client did not receive the disconnect reason", err)
+	}
+}
+
+func TestSSHLimitsClaims(t *testing.T) {
+	sm := NewSessionManager()
+
+	if !sm.Claim("ip-conn/127.0.0.1", 2) || !sm.Claim("ip-conn/127.0.0.1", 2) {
+		t.Fatal("claims within the limit were refused")
+	}
+
+	if sm.Claim("ip-conn/127.0.0.1", 2) {
+		t.Fatal("claim above the limit was allowed")
+	}
+
+	sm.Release("ip-conn/127.0.0.1")
+
+	if sm.Claims("ip-conn/127.0.0.1") != 1 || !sm.Claim("ip-conn/127.0.0.1", 2) {
+		t.Fatal("released claim was not given back")
+	}
+}
+
+func TestSSHUserConnections(t *testing.T) {
+	conf := NewRouteConfig(0, -1, func(act flux.ActionInterface) {})
+	port := freePort(t)
+
+	serv := PasswordSSHProtocol(conf, "io", "127.0.0.1", port, "./perm/perm", func(c ssh.ConnMetadata, b []byte) (*ssh.Permissions, error) {
+		return nil, nil
+	})
+	defer serv.Drop()
+
+	serv.UseLimits(&SSHLimits{UserConnections: 1})
+
+	go serv.Dial()
+
+	client := dialSSHProtocol(t, port)
+	defer client.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for serv.sessions.Claims(limitKey("user-conn", "alex")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection did not claim the user limit")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	var banner string
+
+	_, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &ssh.ClientConfig{
+		User: "alex",
+		Auth: []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			return nil
+		},
+		BannerCallback: func(msg string) error {
+			banner = msg
+			return nil
+		},
+	})
+
+	if err == nil {
+		t.Fatal("expected connection above the user limit to be refused")
+	}
+
+	if banner != "too many connections\n" {
+		t.Fatalf("client was not told why it was refused, got banner %q", banner)
+	}
+}
@@ -84,6 +84,70 @@ func PasswordSSHProtocolLink(service, addr string, port int, user string, passwo
 	return nsh
 }
 
+//CertSSHProtocolLink returns a new sshProtocollink authenticating with the user
+//certificate of the private key
+func CertSSHProtocolLink(service, addr string, port int, user string, pkeyFile, certFile string) *SSHProtocolLink {
+
+	pbytes, err := ioutil.ReadFile(pkeyFile)
+
+	if err != nil {
+		panic(fmt.Sprintf("ReadError %v \nFailed to load private key file: %s", err, pkeyFile))
+	}
+
+	private, err := ssh.ParsePrivateKey(pbytes)
+
+	if err != nil {
+		log.Println(fmt.Sprintf("ParseError:(%s):", pkeyFile), err)
+		panic("Failed to parse private key")
+	}
+
+	cert, err := readCertificate(certFile)
+
+	if err != nil {
+		log.Println(fmt.Sprintf("ParseError:(%s):", certFile), err)
+		panic("Failed to parse certificate")
+	}
+
+	signer, err := ssh.NewCertSigner(cert, private)
+
+	if err != nil {
+		log.Println(fmt.Sprintf("CertError:(%s):", certFile), err)
+		panic("Certificate does not match private key")
+	}
+
+	auth := []ssh.AuthMethod{
+		ssh.PublicKeys(signer),
+	}
+
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: auth,
+	}
+
+	desc := NewDescriptor("ssh", service, addr, port, "0", "ssh")
+
+	nsh := &SSHProtocolLink{
+		NewProtocolLink(desc),
+		config,
+		nil,
+		flux.NewAction(),
+	}
+
+	return nsh
+}
+
+//TrustHostAuthority makes the link only accept servers presenting a host
+//certificate for its host signed by one of the authorities
+func (h *SSHProtocolLink) TrustHostAuthority(authorities ...ssh.PublicKey) {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			return isAuthority(authorities, auth)
+		},
+	}
+
+	h.conf.HostKeyCallback = checker.CheckHostKey
+}
+
 //Drop ends the ssh connection
 func (h *SSHProtocolLink) Drop() error {
 	if h.conn != nil {
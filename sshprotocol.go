@@ -13,12 +13,12 @@ import (
 	"runtime/debug"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 	// "github.com/pkg/sftp"
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/honeycast/lxcontroller"
 	"github.com/influx6/flux"
-	"github.com/kr/pty"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -33,6 +33,11 @@ type (
 		TCPCon           net.Listener
 		Before           *NetworkReflex
 		After            *NetworkReflex
+		Limits           *SSHLimits
+		KeepAlive        *SSHKeepAlive
+		channels         map[string]ChannelHandler
+		requests         map[string]RequestHandler
+		auth             *authChain
 	}
 
 	//SSHProxyProtocol handles the sshprotcol created and proxies all its connection
@@ -61,12 +66,15 @@ type (
 		Connection() *ssh.Client
 	}
 
-	//ChannelPayload defines a payload containing the channel and request of the server
+	//ChannelPayload defines a payload containing the channel and request of the server,
+	//the State is shared by all requests of the channel and holds its pty once requested,
+	//the request is handled within Do which lets the channel serve its next request
 	ChannelPayload struct {
-		Chan ssh.Channel
-		Req  *ssh.Request
-		Pty  *Pty
-		Do   *sync.Once
+		Chan  ssh.Channel
+		Req   *ssh.Request
+		Pty   *Pty
+		Do    *RequestOnce
+		State *ChannelState
 	}
 
 	//ChannelNetwork contains specific data which is used to pass data into other
@@ -87,16 +95,20 @@ type (
 		Closer  chan struct{}
 	}
 
-	//ChannelPacket is used to handle off new channel requests from the ssh-server
+	//ChannelPacket is used to handle off new channel requests from the ssh-server,
+	//the Meter counts the bytes of the connection's channels
 	ChannelPacket struct {
-		Conn *ssh.ServerConn
-		Chan <-chan ssh.NewChannel
+		Conn  *ssh.ServerConn
+		Chan  <-chan ssh.NewChannel
+		Meter *SessionMeter
 	}
 
-	//RequestPacket is used to handle off new out of band channel requests from the ssh-server
+	//RequestPacket is used to handle off new out of band channel requests from the ssh-server,
+	//the Meter counts the bytes of the connection's channels
 	RequestPacket struct {
-		Conn *ssh.ServerConn
-		Reqs <-chan *ssh.Request
+		Conn  *ssh.ServerConn
+		Reqs  <-chan *ssh.Request
+		Meter *SessionMeter
 	}
 
 	// //ClientManager provides a function that returns a ssh.Client
@@ -111,6 +123,17 @@ var (
 
 	//ErrTimeout represents a timeout error
 	ErrTimeout = errors.New("Timeout expired!")
+
+	//RequestPriorities sets the route priority of channel requests by their type,
+	//used when the protocol's RouteConfig has a RoutePriority where the requests
+	//of every channel share the queue of the protocol routes, requests with a
+	//priority are also served without waiting on the earlier requests of their
+	//channel
+	RequestPriorities = map[string]int{
+		"window-change":         10,
+		"signal":                10,
+		"keepalive@openssh.com": 10,
+	}
 )
 
 //ClientProxySSHProtocol builds on top of the base proxy
@@ -301,44 +324,20 @@ func BaseProxySSHProtocol(s *SSHProtocol) *SSHProxyProtocol {
 
 //RSASSHProtocol creates a ssh-server that handles ssh-connections
 func RSASSHProtocol(rc *RouteConfig, service, addr string, port int, rsaFile string, auth KeyAuth) *SSHProtocol {
-	pbytes, err := ioutil.ReadFile(rsaFile)
-
-	if err != nil {
-		panic(fmt.Sprintf("ReadError %v \nFailed to load private key file: %s", err, rsaFile))
-	}
-
-	private, err := ssh.ParsePrivateKey(pbytes)
-
-	if err != nil {
-		panic(fmt.Sprintf("ParseError:(%s): \n %s -> %v", rsaFile, "Failed to parse private key!", err))
-	}
-
-	desc := NewDescriptor("ssh", service, addr, port, "0", "ssh")
-
-	conf := &ssh.ServerConfig{
+	return newSSHProtocol(rc, service, addr, port, rsaFile, &ssh.ServerConfig{
 		PublicKeyCallback: auth,
-	}
-
-	conf.AddHostKey(private)
-
-	sd := &SSHProtocol{
-		BaseProtocol(desc, rc),
-		flux.PushSocket(0),
-		flux.PushSocket(0),
-		flux.PushSocket(0),
-		conf,
-		nil,
-		nil,
-		nil,
-	}
-
-	setupServer(sd)
-
-	return sd
+	})
 }
 
 //PasswordSSHProtocol creates a ssh-server that handles ssh-connections
 func PasswordSSHProtocol(rc *RouteConfig, service, addr string, port int, rsaFile string, auth PassAuth) *SSHProtocol {
+	return newSSHProtocol(rc, service, addr, port, rsaFile, &ssh.ServerConfig{
+		PasswordCallback: auth,
+	})
+}
+
+//newSSHProtocol creates a ssh-server with the config using the private key as its host key
+func newSSHProtocol(rc *RouteConfig, service, addr string, port int, rsaFile string, conf *ssh.ServerConfig) *SSHProtocol {
 	pbytes, err := ioutil.ReadFile(rsaFile)
 
 	if err != nil {
@@ -353,10 +352,6 @@ func PasswordSSHProtocol(rc *RouteConfig, service, addr string, port int, rsaFil
 
 	desc := NewDescriptor("ssh", service, addr, port, "0", "ssh")
 
-	conf := &ssh.ServerConfig{
-		PasswordCallback: auth,
-	}
-
 	conf.AddHostKey(private)
 
 	sd := &SSHProtocol{
@@ -368,6 +363,11 @@ func PasswordSSHProtocol(rc *RouteConfig, service, addr string, port int, rsaFil
 		nil,
 		nil,
 		nil,
+		nil,
+		nil,
+		make(map[string]ChannelHandler),
+		make(map[string]RequestHandler),
+		nil,
 	}
 
 	setupServer(sd)
@@ -381,6 +381,8 @@ func setupServer(s *SSHProtocol) {
 	s.Routes().New("session/env")
 	s.Routes().New("session/shell")
 	s.Routes().New("session/window-change")
+	s.Routes().New("session/signal")
+	s.Routes().New("session/subsystem")
 	AddStandardChannelManager(s)
 	AddOutBoundRequestManager(s)
 }
@@ -483,7 +485,13 @@ func AddRedirectBehaviour(s *SSHProtocol) {
 
 //AddPtyBehaviour allows to add the default response/actions for pty-request
 func AddPtyBehaviour(s *SSHProtocol) {
-	s.Routes().Child("session/pty-req").Sub(func(data *Request, s *flux.Sub) {
+	AddPtyRouteBehaviour(s.Routes().Child("session/pty-req"))
+}
+
+//AddPtyRouteBehaviour allows to add the default response/actions for pty-request
+//per route
+func AddPtyRouteBehaviour(s *Route) {
+	s.Sub(func(data *Request, s *flux.Sub) {
 		log.Println("receiving pty-req request:", data.Paths)
 
 		payload, ok := data.Payload.(*PayloadRack)
@@ -499,13 +507,33 @@ func AddPtyBehaviour(s *SSHProtocol) {
 				return
 			}
 
-			if cpay.Pty != nil {
+			if cpay.State != nil {
 				cpay.Do.Do(func() {
+					if !Permitted(cpay.State.Permissions(), PermitPty) {
+						log.Printf("Refusing pty for (%s)", cpay.State.Conn.User())
+						if cpay.Req.WantReply {
+							cpay.Req.Reply(false, nil)
+						}
+						return
+					}
+
+					pt, err := cpay.State.OpenPty()
+
+					if err != nil {
+						log.Printf("Unable to open pty (%+v)", err)
+						if cpay.Req.WantReply {
+							cpay.Req.Reply(false, nil)
+						}
+						return
+					}
+
 					log.Println("Pty allowed!")
+					cpay.Pty = pt
 					termlen := cpay.Req.Payload[3]
 					termEnv := string(cpay.Req.Payload[4 : termlen+4])
 					w, h := ParseDimension(cpay.Req.Payload[termlen+4:])
 					MurphWindow(cpay.Pty.Pfd.Fd(), w, h)
+					cpay.State.SetTerm(termEnv)
 					log.Printf("Pty morhp for '%s'", termEnv)
 
 					if cpay.Req.WantReply {
@@ -520,11 +548,17 @@ func AddPtyBehaviour(s *SSHProtocol) {
 
 //AddShellBehaviour allows to add the default response/actions for shell-request
 func AddShellBehaviour(s *SSHProtocol) {
+	AddShellRouteBehaviour(s.Routes().Child("session/shell"))
+}
+
+//AddShellRouteBehaviour allows to add the default response/actions for shell-request
+//per route
+func AddShellRouteBehaviour(s *Route) {
 	if shell == "" {
 		shell = "sh"
 	}
 
-	s.Routes().Child("session/shell").Sub(func(data *Request, s *flux.Sub) {
+	s.Sub(func(data *Request, s *flux.Sub) {
 		log.Println("Receiving Request:", data.Paths)
 
 		payload, ok := data.Payload.(*PayloadRack)
@@ -540,35 +574,28 @@ func AddShellBehaviour(s *SSHProtocol) {
 				return
 			}
 
-			if cpay.Pty != nil {
+			if cpay.State != nil {
 				cpay.Do.Do(func() {
-					log.Println("Pty allowed!")
+					log.Println("Shell allowed!")
 
 					cmd := exec.Command(shell)
-					cmd.Env = []string{"TERM=xterm"}
+					cmd.Env = cpay.State.Environ()
+
+					if forced, ok := ForcedCommand(cpay.State.Permissions()); ok {
+						cmd = exec.Command(shell, []string{"-c", forced}...)
+						cmd.Env = cpay.State.Environ()
+					}
 
-					err := PtyRun(cmd, cpay.Pty.Tty)
+					err := StartChannelCommand(cpay, cmd)
 
 					if err != nil {
 						log.Printf("Error running shell command %+v", err)
+						if cpay.Req.WantReply {
+							cpay.Req.Reply(false, nil)
+						}
+						return
 					}
 
-					teardown := new(sync.Once)
-					closer := func() {
-						cpay.Chan.Close()
-						log.Printf("Closing session")
-					}
-
-					go func() {
-						io.Copy(cpay.Chan, cpay.Pty.Pfd)
-						teardown.Do(closer)
-					}()
-
-					go func() {
-						io.Copy(cpay.Pty.Pfd, cpay.Chan)
-						teardown.Do(closer)
-					}()
-
 					if cpay.Req.WantReply {
 						//For now commands are not being supported but still up for discussion
 						if len(cpay.Req.Payload) == 0 {
@@ -586,11 +613,17 @@ func AddShellBehaviour(s *SSHProtocol) {
 
 //AddWindowChangeBehaviour allows to add the default response/actions for window-change behaviour
 func AddWindowChangeBehaviour(s *SSHProtocol) {
+	AddWindowChangeRouteBehaviour(s.Routes().Child("session/window-change"))
+}
+
+//AddWindowChangeRouteBehaviour allows to add the default response/actions for
+//window-change behaviour per route
+func AddWindowChangeRouteBehaviour(s *Route) {
 	if shell == "" {
 		shell = "sh"
 	}
 
-	s.Routes().Child("session/window-change").Sub(func(data *Request, s *flux.Sub) {
+	s.Sub(func(data *Request, s *flux.Sub) {
 		log.Println("Receiving request:", data.Paths)
 
 		payload, ok := data.Payload.(*PayloadRack)
@@ -606,6 +639,10 @@ func AddWindowChangeBehaviour(s *SSHProtocol) {
 				return
 			}
 
+			if cpay.Pty == nil && cpay.State != nil {
+				cpay.Pty = cpay.State.Terminal()
+			}
+
 			if cpay.Pty != nil {
 				cpay.Do.Do(func() {
 					w, h := ParseDimension(cpay.Req.Payload)
@@ -622,11 +659,17 @@ func AddWindowChangeBehaviour(s *SSHProtocol) {
 
 //AddExecBehaviour allows to add the default response/actions for exec-request
 func AddExecBehaviour(s *SSHProtocol) {
+	AddExecRouteBehaviour(s.Routes().Child("session/exec"))
+}
+
+//AddExecRouteBehaviour allows to add the default response/actions for exec-request
+//per route
+func AddExecRouteBehaviour(s *Route) {
 	if shell == "" {
 		shell = "sh"
 	}
 
-	s.Routes().Child("session/exec").Sub(func(data *Request, s *flux.Sub) {
+	s.Sub(func(data *Request, s *flux.Sub) {
 		log.Println("receiving request:", data.Paths)
 
 		payload, ok := data.Payload.(*PayloadRack)
@@ -642,17 +685,22 @@ func AddExecBehaviour(s *SSHProtocol) {
 				return
 			}
 
-			if cpay.Pty != nil {
+			if cpay.State != nil {
 				cpay.Do.Do(func() {
-					log.Println("Pty Exec command allowed!")
+					log.Println("Exec command allowed!")
 					command := string(cpay.Req.Payload[4 : cpay.Req.Payload[3]+4])
-					cmd := exec.Command(shell, []string{"-c", command}...)
+					env := cpay.State.Environ()
 
-					cmd.Stdout = cpay.Chan
-					cmd.Stdin = cpay.Chan
-					cmd.Stderr = cpay.Chan
+					//a forced command gets the requested one as sshd does
+					if forced, ok := ForcedCommand(cpay.State.Permissions()); ok {
+						env = append(env, "SSH_ORIGINAL_COMMAND="+command)
+						command = forced
+					}
+
+					cmd := exec.Command(shell, []string{"-c", command}...)
+					cmd.Env = env
 
-					err := cmd.Start()
+					err := StartChannelCommand(cpay, cmd)
 
 					if err != nil {
 						log.Printf("Could not start command (%s)", err)
@@ -662,16 +710,6 @@ func AddExecBehaviour(s *SSHProtocol) {
 						return
 					}
 
-					go func() {
-						_, err := cmd.Process.Wait()
-
-						if err != nil {
-							log.Printf("Failed to exit shell (%s)", err)
-						}
-						cpay.Chan.Close()
-						log.Printf("Session closed")
-					}()
-
 					if cpay.Req.WantReply {
 						cpay.Req.Reply(true, nil)
 					}
@@ -682,6 +720,92 @@ func AddExecBehaviour(s *SSHProtocol) {
 	})
 }
 
+//AddEnvBehaviour allows to add the default response/actions for env-request
+func AddEnvBehaviour(s *SSHProtocol) {
+	AddEnvRouteBehaviour(s.Routes().Child("session/env"))
+}
+
+//AddEnvRouteBehaviour allows to add the default response/actions for env-request
+//per route, only the variables allowed by AllowEnvironment are set
+func AddEnvRouteBehaviour(s *Route) {
+	s.Sub(func(data *Request, s *flux.Sub) {
+		log.Println("receiving env request:", data.Paths)
+
+		payload, ok := data.Payload.(*PayloadRack)
+
+		if !ok {
+			return
+		}
+
+		payload.Release().When(func(d interface{}, _ flux.ActionInterface) {
+			cpay, ok := d.(*ChannelPayload)
+
+			if !ok || cpay.State == nil {
+				return
+			}
+
+			cpay.Do.Do(func() {
+				var env envMsg
+
+				allowed := ssh.Unmarshal(cpay.Req.Payload, &env) == nil && cpay.State.SetEnv(env.Name, env.Value)
+
+				if !allowed {
+					log.Printf("Refusing environment variable '%s'", env.Name)
+				}
+
+				if cpay.Req.WantReply {
+					cpay.Req.Reply(allowed, nil)
+				}
+			})
+		})
+	})
+}
+
+//AddSignalBehaviour allows to add the default response/actions for signal-request
+func AddSignalBehaviour(s *SSHProtocol) {
+	AddSignalRouteBehaviour(s.Routes().Child("session/signal"))
+}
+
+//AddSignalRouteBehaviour allows to add the default response/actions for
+//signal-request per route, delivering the signal to the channel's command
+func AddSignalRouteBehaviour(s *Route) {
+	s.Sub(func(data *Request, s *flux.Sub) {
+		log.Println("receiving signal request:", data.Paths)
+
+		payload, ok := data.Payload.(*PayloadRack)
+
+		if !ok {
+			return
+		}
+
+		payload.Release().When(func(d interface{}, _ flux.ActionInterface) {
+			cpay, ok := d.(*ChannelPayload)
+
+			if !ok || cpay.State == nil {
+				return
+			}
+
+			cpay.Do.Do(func() {
+				var sig signalMsg
+
+				err := ssh.Unmarshal(cpay.Req.Payload, &sig)
+
+				if err == nil {
+					err = cpay.State.Signal(sig.Signal)
+				}
+
+				if err != nil {
+					log.Printf("Unable to deliver signal '%s': %+v", sig.Signal, err)
+				}
+
+				if cpay.Req.WantReply {
+					cpay.Req.Reply(err == nil, nil)
+				}
+			})
+		})
+	})
+}
+
 //Dial creates and connects the ssh server with the given details from the ProtocolDescription
 func (s *SSHProtocol) Dial() error {
 
@@ -738,25 +862,48 @@ func (s *SSHProtocol) Dial() error {
 
 			log.Printf("Accepting Connection Request from %s", con.RemoteAddr())
 
+			if !s.claimAddr(con) {
+				log.Printf("TCPACCEPT-STAGE: Too many connections from %s", con.RemoteAddr())
+				continue loopmaker
+			}
+
 			conn, schan, req, err := ssh.NewServerConn(con, s.ServerConf)
 
 			if err != nil {
+				s.releaseAddr(con.RemoteAddr())
 				log.Println(fmt.Sprintf("TCPACCEPT-STAGE: Unable to accept connection: -> %v", err))
 				continue loopmaker
 			}
 
 			if conn == nil || schan == nil || req == nil {
+				s.releaseAddr(con.RemoteAddr())
 				log.Println("Nill pointer encountered in NewServerConn op")
 				continue loopmaker
 			}
 
+			if !s.claimUser(conn) {
+				s.releaseAddr(con.RemoteAddr())
+				log.Printf("TCPACCEPT-STAGE: Too many connections for user %s", conn.User())
+				conn.Close()
+				continue loopmaker
+			}
+
+			if s.auth != nil {
+				s.auth.lockout.reset(remoteIP(conn.RemoteAddr()))
+			}
+
 			log.Println("New Connection created:", conn.RemoteAddr(), conn.LocalAddr())
 			// defer conn.Close()
 
 			// log.Println("Emitting New Channel")
-			s.NetworkChannels.Emit(&ChannelPacket{conn, schan})
+			meter := NewSessionMeter()
+			meter.session = s.addSession(conn)
+			go s.watchConn(conn, meter)
+			go s.keepAlive(conn, meter)
+
+			s.NetworkChannels.Emit(&ChannelPacket{conn, schan, meter})
 			// log.Println("Emitting Outof Bound")
-			s.NetworkOutbounds.Emit(&RequestPacket{conn, req})
+			s.NetworkOutbounds.Emit(&RequestPacket{conn, req, meter})
 
 			//dont starve the cpu
 			if s.After != nil {
@@ -801,37 +948,45 @@ func AddStandardChannelManager(s *SSHProtocol) {
 
 			channelProc := func(curChan ssh.NewChannel) {
 				stype := curChan.ChannelType()
+				handle, hasHandler := s.channels[stype]
 				rw := s.Routes().Child(stype)
 
-				if rw == nil {
+				if rw == nil && !hasHandler {
 					curChan.Reject(ssh.UnknownChannelType, "unknown not supported!")
 					return
 					// continue
 				}
 
-				log.Printf("Accepting connections for (%s)", stype)
-
-				ch, reqs, err := curChan.Accept()
+				release, ok := s.claimChannel(d)
 
-				if err != nil {
-					log.Println("Error accepting channel: ", err)
+				if !ok {
+					curChan.Reject(ssh.ResourceShortage, "too many channels")
 					return
-					// continue
 				}
 
-				log.Printf("Creating pty terminal for (%s)", stype)
+				if hasHandler {
+					go func() {
+						defer release()
+						handle(d, curChan, packet.Meter)
+					}()
+					return
+				}
 
-				fd, tty, err := pty.Open()
+				log.Printf("Accepting connections for (%s)", stype)
 
-				log.Printf("Pty Successful? %+v ", err == nil)
+				ch, reqs, err := curChan.Accept()
 
 				if err != nil {
-					log.Printf("Unable to open pty (%+v):(%+v)", err, fd)
+					release()
+					log.Println("Error accepting channel: ", err)
 					return
 					// continue
 				}
 
-				pterm := &Pty{tty, fd}
+				ch = packet.Meter.Channel(ch)
+				s.emitConn(SessionChannelOpened, d, packet.Meter, stype, "")
+
+				state := NewChannelState(d)
 
 				s.NetworkOpen.Emit(&ChannelNetwork{
 					d,
@@ -840,11 +995,25 @@ func AddStandardChannelManager(s *SSHProtocol) {
 					closer,
 					s.ProtocolClosed,
 					reqs,
-					pterm,
+					nil,
 					// nil,
 				})
 
 				go func(in <-chan *ssh.Request) {
+					//clients send pty-req, env and shell or exec without waiting on
+					//their replies so they are handled one at a time in order
+					serial := make(chan *ssh.Request, 16)
+					defer close(serial)
+
+					go func() {
+						defer release()
+						defer state.Close()
+
+						for greq := range serial {
+							s.serveChannelRequest(stype, ch, greq, state, true)
+						}
+					}()
+
 				chanHandle:
 					for greq := range in {
 						reqtype := greq.Type
@@ -854,13 +1023,15 @@ func AddStandardChannelManager(s *SSHProtocol) {
 							break chanHandle
 						}
 
-						path := fmt.Sprintf("%s/%s/%s", s.Descriptor().Service, stype, reqtype)
-						s.Routes().Serve(path, &ChannelPayload{
-							ch,
-							greq,
-							pterm,
-							new(sync.Once),
-						}, -1)
+						s.emitConn(SessionRequest, d, packet.Meter, stype, reqtype)
+
+						//window changes and signals are not held up by the requests before them
+						if RequestPriorities[reqtype] > 0 {
+							s.serveChannelRequest(stype, ch, greq, state, false)
+							continue
+						}
+
+						serial <- greq
 					}
 				}(reqs)
 			}
@@ -887,6 +1058,39 @@ func AddStandardChannelManager(s *SSHProtocol) {
 	})
 }
 
+//serveChannelRequest serves the request of the channel into its route, with
+//wait it returns once the request was handled or ChannelRequestWait passed so
+//the next request of the channel is only served after it
+func (s *SSHProtocol) serveChannelRequest(stype string, ch ssh.Channel, req *ssh.Request, state *ChannelState, wait bool) {
+	cpay := &ChannelPayload{
+		ch,
+		req,
+		state.Terminal(),
+		NewRequestOnce(),
+		state,
+	}
+
+	path := fmt.Sprintf("%s/%s/%s", s.Descriptor().Service, stype, req.Type)
+	s.Routes().ServePriority(path, cpay, -1, RequestPriorities[req.Type])
+
+	if !wait {
+		return
+	}
+
+	//requests without a handler are never marked as handled
+	rw := s.Routes().Child(stype + "/" + req.Type)
+
+	if rw == nil || len(rw.Subscribers()) == 0 {
+		return
+	}
+
+	select {
+	case <-cpay.Do.Done():
+	case <-time.After(ChannelRequestWait):
+		log.Printf("Channel request (%s) was not handled within %s", req.Type, ChannelRequestWait)
+	}
+}
+
 //AddProxyChannelManager manages the handling of a ConnectionChannel requests channels
 func AddProxyChannelManager(s *SSHProtocol) {
 	s.NetworkChannels.Subscribe(func(pack interface{}, sub *flux.Sub) {
@@ -919,16 +1123,33 @@ func AddProxyChannelManager(s *SSHProtocol) {
 					// continue
 				}
 
+				release, ok := s.claimChannel(d)
+
+				if !ok {
+					curChan.Reject(ssh.ResourceShortage, "too many channels")
+					return
+				}
+
 				log.Printf("Accepting connections for (%s)", stype)
 
 				ch, reqs, err := curChan.Accept()
 
 				if err != nil {
+					release()
 					log.Println("TCPACCEPT: Error accepting channel: ", err)
 					return
 					// continue
 				}
 
+				ch = packet.Meter.Channel(ch)
+				s.emitConn(SessionChannelOpened, d, packet.Meter, stype, "")
+
+				//the proxied channel is owned by the proxy so it is released with the connection
+				go func() {
+					d.Wait()
+					release()
+				}()
+
 				s.NetworkOpen.Emit(&ChannelNetwork{
 					d,
 					ch,
@@ -967,6 +1188,7 @@ func AddProxyChannelManager(s *SSHProtocol) {
 }
 
 //AddOutBoundRequestManager simple handless a ssh.ServerConn  out-of-bounds request
+//with the handler added for its type with AddRequestHandler
 func AddOutBoundRequestManager(s *SSHProtocol) {
 	s.NetworkOutbounds.Subscribe(func(pack interface{}, sub *flux.Sub) {
 		packet, ok := pack.(*RequestPacket)
@@ -976,7 +1198,24 @@ func AddOutBoundRequestManager(s *SSHProtocol) {
 			return
 		}
 
-		// log.Printf("Discarding Out-Of-Bands Requests: %v", packet)
-		ssh.DiscardRequests(packet.Reqs)
+		//requests without a handler are refused as ssh.DiscardRequests does
+		go func() {
+			for req := range packet.Reqs {
+				handle, ok := s.requests[req.Type]
+
+				if !ok {
+					if req.WantReply {
+						req.Reply(false, nil)
+					}
+					continue
+				}
+
+				done, payload := handle(packet.Conn, req, packet.Meter)
+
+				if req.WantReply {
+					req.Reply(done, payload)
+				}
+			}
+		}()
 	})
 }
@@ -0,0 +1,456 @@
+package servicedrop
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/influx6/flux"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+//ErrPathEscape is returned for sftp paths resolving outside the user's root
+var ErrPathEscape = errors.New("path escapes the sftp root")
+
+//SFTPConfig configures the sftp subsystem, Root returns the directory served
+//to a user and ReadOnly refuses every change to the served files
+type SFTPConfig struct {
+	Root     func(user string) (string, error)
+	ReadOnly bool
+}
+
+//SFTPDirectory returns a root serving the same directory to every user
+func SFTPDirectory(dir string) func(string) (string, error) {
+	return func(string) (string, error) {
+		return dir, nil
+	}
+}
+
+//SFTPUserDirectory returns a root serving each user its own directory within
+//the base directory, creating it if it does not exist
+func SFTPUserDirectory(base string) func(string) (string, error) {
+	return func(user string) (string, error) {
+		if user == "" || user != filepath.Base(user) || user == "." || user == ".." {
+			return "", ErrPathEscape
+		}
+
+		dir := filepath.Join(base, user)
+		return dir, os.MkdirAll(dir, 0700)
+	}
+}
+
+//subsystemMsg is the payload of a subsystem channel request
+type subsystemMsg struct {
+	Name string
+}
+
+//AddSFTPBehaviour allows to add the default response/actions for sftp subsystem-requests
+func AddSFTPBehaviour(s *SSHProtocol, conf *SFTPConfig) {
+	AddSFTPRouteBehaviour(s.Routes().Child("session/subsystem"), conf)
+}
+
+//AddSFTPRouteBehaviour allows to add the default response/actions for sftp
+//subsystem-requests per route, serving the channel's user their root directory,
+//connections with a forced command are refused
+func AddSFTPRouteBehaviour(s *Route, conf *SFTPConfig) {
+	s.Sub(func(data *Request, s *flux.Sub) {
+		log.Println("receiving subsystem request:", data.Paths)
+
+		payload, ok := data.Payload.(*PayloadRack)
+
+		if !ok {
+			return
+		}
+
+		payload.Release().When(func(d interface{}, _ flux.ActionInterface) {
+			cpay, ok := d.(*ChannelPayload)
+
+			if !ok || cpay.State == nil || cpay.State.Conn == nil {
+				return
+			}
+
+			cpay.Do.Do(func() {
+				var sub subsystemMsg
+
+				_, forced := ForcedCommand(cpay.State.Permissions())
+
+				if err := ssh.Unmarshal(cpay.Req.Payload, &sub); err != nil || sub.Name != "sftp" || forced {
+					log.Printf("Refusing subsystem '%s'", sub.Name)
+					if cpay.Req.WantReply {
+						cpay.Req.Reply(false, nil)
+					}
+					return
+				}
+
+				fs, err := newRootedFS(conf, cpay.State.Conn.User())
+
+				if err != nil {
+					log.Printf("Unable to serve sftp for (%s): %+v", cpay.State.Conn.User(), err)
+					if cpay.Req.WantReply {
+						cpay.Req.Reply(false, nil)
+					}
+					return
+				}
+
+				server := sftp.NewRequestServer(cpay.Chan, sftp.Handlers{
+					FileGet:  fs,
+					FilePut:  fs,
+					FileCmd:  fs,
+					FileList: fs,
+				})
+
+				if cpay.Req.WantReply {
+					cpay.Req.Reply(true, nil)
+				}
+
+				go func() {
+					var status uint32
+
+					if err := server.Serve(); err != nil && err != io.EOF {
+						log.Printf("Sftp session ended with (%s)", err)
+						status = 1
+					}
+
+					server.Close()
+					cpay.Chan.SendRequest("exit-status", false, ssh.Marshal(&exitStatusMsg{status}))
+					cpay.Chan.Close()
+				}()
+			})
+		})
+	})
+}
+
+//rootedFS provides the sftp handlers for the files within a root directory
+type rootedFS struct {
+	root     string
+	readOnly bool
+}
+
+//newRootedFS returns the sftp handlers for the user's root
+func newRootedFS(conf *SFTPConfig, user string) (*rootedFS, error) {
+	root, err := conf.Root(user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.Abs(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+
+	return &rootedFS{root, conf.ReadOnly}, nil
+}
+
+//resolve returns the file path of the sftp path within the root, following
+//any symlinks to make sure the file does not escape the root
+func (r *rootedFS) resolve(p string) (string, error) {
+	full := filepath.Join(r.root, filepath.FromSlash(path.Clean("/"+p)))
+
+	//the file may not exist yet so its deepest existing parent is checked
+	real, rest := full, ""
+
+	for {
+		resolved, err := filepath.EvalSymlinks(real)
+
+		if err == nil {
+			real = filepath.Join(resolved, rest)
+			break
+		}
+
+		if !os.IsNotExist(err) || real == r.root {
+			return "", err
+		}
+
+		rest = filepath.Join(filepath.Base(real), rest)
+		real = filepath.Dir(real)
+	}
+
+	if real != r.root && !strings.HasPrefix(real, r.root+string(filepath.Separator)) {
+		return "", ErrPathEscape
+	}
+
+	return real, nil
+}
+
+//resolveLink returns the file path of the sftp path within the root without
+//following the path itself, so links are acted on instead of their targets
+func (r *rootedFS) resolveLink(p string) (string, error) {
+	clean := path.Clean("/" + p)
+
+	if clean == "/" {
+		return r.root, nil
+	}
+
+	dir, err := r.resolve(path.Dir(clean))
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, path.Base(clean)), nil
+}
+
+//Fileread opens the file for reading
+func (r *rootedFS) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	file, err := r.resolve(req.Filepath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(file)
+}
+
+//Filewrite opens the file for writing
+func (r *rootedFS) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	if r.readOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	file, err := r.resolve(req.Filepath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	flags := os.O_WRONLY
+	pf := req.Pflags()
+
+	if pf.Creat {
+		flags |= os.O_CREATE
+	}
+
+	if pf.Trunc {
+		flags |= os.O_TRUNC
+	}
+
+	if pf.Excl {
+		flags |= os.O_EXCL
+	}
+
+	return os.OpenFile(file, flags, 0644)
+}
+
+//Filecmd performs the changes to files, links are refused as they could
+//point outside the root
+func (r *rootedFS) Filecmd(req *sftp.Request) error {
+	if r.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	//renames and removals act on links themselves so only their parent is resolved
+	switch req.Method {
+	case "Rename":
+		file, err := r.resolveLink(req.Filepath)
+
+		if err != nil {
+			return err
+		}
+
+		target, err := r.resolveLink(req.Target)
+
+		if err != nil {
+			return err
+		}
+
+		if file == r.root || target == r.root {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+
+		return os.Rename(file, target)
+	case "Rmdir", "Remove":
+		file, err := r.resolveLink(req.Filepath)
+
+		if err != nil {
+			return err
+		}
+
+		if file == r.root {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+
+		return os.Remove(file)
+	}
+
+	file, err := r.resolve(req.Filepath)
+
+	if err != nil {
+		return err
+	}
+
+	switch req.Method {
+	case "Setstat":
+		return r.setstat(file, req)
+	case "Mkdir":
+		return os.Mkdir(file, 0755)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+//setstat changes the attributes of the file
+func (r *rootedFS) setstat(file string, req *sftp.Request) error {
+	flags := req.AttrFlags()
+	attrs := req.Attributes()
+
+	if flags.Size {
+		if err := os.Truncate(file, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+
+	if flags.Permissions {
+		if err := os.Chmod(file, os.FileMode(attrs.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+
+	if flags.Acmodtime {
+		at := time.Unix(int64(attrs.Atime), 0)
+		mt := time.Unix(int64(attrs.Mtime), 0)
+
+		if err := os.Chtimes(file, at, mt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Filelist lists directories, stats files and reads links, links are stated and
+//read themselves instead of their targets
+func (r *rootedFS) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	switch req.Method {
+	case "Lstat":
+		return r.Lstat(req)
+	case "Readlink":
+		return r.readlink(req)
+	}
+
+	file, err := r.resolve(req.Filepath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Method {
+	case "List":
+		dir, err := os.Open(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer dir.Close()
+
+		infos, err := dir.Readdir(-1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return fileInfos(infos), nil
+	case "Stat":
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return fileInfos{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+//Lstat stats the file without following it if it is a link
+func (r *rootedFS) Lstat(req *sftp.Request) (sftp.ListerAt, error) {
+	file, err := r.resolveLink(req.Filepath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fileInfos{info}, nil
+}
+
+//readlink returns the target of the link as the name of its info, absolute
+//targets are given as sftp paths within the root and those outside it are refused
+func (r *rootedFS) readlink(req *sftp.Request) (sftp.ListerAt, error) {
+	file, err := r.resolveLink(req.Filepath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := os.Readlink(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.IsAbs(target) {
+		rel, err := filepath.Rel(r.root, filepath.Clean(target))
+
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, ErrPathEscape
+		}
+
+		target = path.Join("/", filepath.ToSlash(rel))
+	}
+
+	return fileInfos{linkInfo{info, target}}, nil
+}
+
+//linkInfo is the info of a link named after its target
+type linkInfo struct {
+	os.FileInfo
+	target string
+}
+
+//Name returns the target of the link
+func (l linkInfo) Name() string {
+	return l.target
+}
+
+//fileInfos is a sftp.ListerAt of file infos
+type fileInfos []os.FileInfo
+
+//ListAt copies the infos from the offset into the list
+func (f fileInfos) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(f)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, f[offset:])
+
+	if n < len(ls) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
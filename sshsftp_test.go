@@ -0,0 +1,155 @@
+package servicedrop
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func startSFTPProtocol(t *testing.T, conf *SFTPConfig) (*SSHProtocol, *sftp.Client) {
+	serv, port := startExecProtocol(t)
+	AddSFTPBehaviour(serv, conf)
+
+	client := dialSSHProtocol(t, port)
+	fs, err := sftp.NewClient(client)
+
+	if err != nil {
+		client.Close()
+		serv.Drop()
+		t.Fatal("unable to start sftp client", err)
+	}
+
+	return serv, fs
+}
+
+func TestSFTPSubsystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	outside, err := ioutil.TempDir("", "sftp-outside")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(outside)
+
+	ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+
+	serv, fs := startSFTPProtocol(t, &SFTPConfig{Root: SFTPUserDirectory(dir)})
+	defer serv.Drop()
+	defer fs.Close()
+
+	file, err := fs.Create("/notes.txt")
+
+	if err != nil {
+		t.Fatal("unable to create file", err)
+	}
+
+	file.Write([]byte("hello"))
+	file.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "alex", "notes.txt"))
+
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("file was not written within the user root: %q %+v", data, err)
+	}
+
+	if _, err := fs.Open("/../../" + filepath.Base(outside) + "/secret"); err == nil {
+		t.Fatal("path outside the root was opened")
+	}
+
+	os.Symlink(outside, filepath.Join(dir, "alex", "escape"))
+
+	if _, err := fs.Open("/escape/secret"); err == nil {
+		t.Fatal("symlink outside the root was followed")
+	}
+	os.Symlink("notes.txt", filepath.Join(dir, "alex", "link"))
+
+	if err := fs.Rename("/link", "/moved"); err != nil {
+		t.Fatal("unable to rename symlink", err)
+	}
+
+	if info, err := os.Lstat(filepath.Join(dir, "alex", "moved")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("rename did not move the symlink itself", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "alex", "notes.txt")); err != nil {
+		t.Fatal("rename moved the symlink target", err)
+	}
+
+	if info, err := fs.Lstat("/moved"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("lstat did not stat the symlink itself", err)
+	}
+
+	if target, err := fs.ReadLink("/moved"); err != nil || target != "notes.txt" {
+		t.Fatalf("incorrect symlink target: %q %+v", target, err)
+	}
+
+	os.Symlink(filepath.Join(dir, "alex", "notes.txt"), filepath.Join(dir, "alex", "absolute"))
+
+	if target, err := fs.ReadLink("/absolute"); err != nil || target != "/notes.txt" {
+		t.Fatalf("absolute symlink target was not given within the root: %q %+v", target, err)
+	}
+
+	if _, err := fs.ReadLink("/escape"); err == nil {
+		t.Fatal("symlink target outside the root was read")
+	}
+
+	if err := fs.Remove("/escape"); err != nil {
+		t.Fatal("unable to remove symlink outside the root", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "alex", "escape")); !os.IsNotExist(err) {
+		t.Fatal("symlink was not removed", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Fatal("remove followed the symlink outside the root", err)
+	}
+}
+
+func TestSFTPReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644)
+
+	serv, fs := startSFTPProtocol(t, &SFTPConfig{Root: SFTPDirectory(dir), ReadOnly: true})
+	defer serv.Drop()
+	defer fs.Close()
+
+	file, err := fs.Open("/notes.txt")
+
+	if err != nil {
+		t.Fatal("unable to open file", err)
+	}
+
+	data, _ := ioutil.ReadAll(file)
+	file.Close()
+
+	if string(data) != "hello" {
+		t.Fatalf("incorrect file content: %q", data)
+	}
+
+	if _, err := fs.Create("/new.txt"); err == nil {
+		t.Fatal("file was created on a read-only root")
+	}
+
+	if err := fs.Remove("/notes.txt"); err == nil {
+		t.Fatal("file was removed on a read-only root")
+	}
+}